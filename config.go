@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// projectSettings are flags the Dockerfile can also set. The Dockerfile takes
+// precedence over the global config, so they can not be set there.
+var projectSettings = map[string]string{
+	"cp-base":        "DAPPER_CP_BASE",
+	"gpus":           "DAPPER_RUN_GPUS",
+	"shm-size":       "DAPPER_RUN_SHM_SIZE",
+	"socket":         "DAPPER_DOCKER_SOCKET",
+	"max-image-size": "DAPPER_MAX_IMAGE_SIZE",
+	"fail-on-layers": "DAPPER_MAX_LAYERS",
+}
+
+func configFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "dapper", "config.yaml"), nil
+}
+
+// applyConfig sets the flags that were not given on the command line or in
+// the environment from the global config file, if it exists.
+func applyConfig(c *cli.Context) error {
+	path, err := configFile()
+	if err != nil {
+		logrus.Debugf("Not reading global config: %v", err)
+		return nil
+	}
+
+	config, err := readConfig(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	flags := map[string]string{}
+	for _, f := range c.App.Flags {
+		names := strings.Split(f.GetName(), ",")
+		for _, name := range names {
+			flags[strings.TrimSpace(name)] = strings.TrimSpace(names[0])
+		}
+	}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name, ok := flags[flagName(key)]
+		if !ok {
+			logrus.Warnf("Ignoring unknown key %s in %s", key, path)
+			continue
+		}
+		if variable, ok := projectSettings[name]; ok {
+			logrus.Warnf("Ignoring %s in %s, set %s in the Dockerfile instead", key, path, variable)
+			continue
+		}
+		if c.IsSet(name) {
+			continue
+		}
+		for _, value := range config[key] {
+			if err := c.Set(name, value); err != nil {
+				return fmt.Errorf("Invalid %s in %s: %v", key, path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// flagName returns the flag for a config key, which is either the flag name
+// or the flag name in camel case, such as MountSuffix for mount-suffix.
+func flagName(key string) string {
+	name := strings.Builder{}
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				name.WriteRune('-')
+			}
+			r = unicode.ToLower(r)
+		}
+		name.WriteRune(r)
+	}
+	return name.String()
+}
+
+// readConfig reads the simple YAML of the global config: a mapping of keys to
+// scalar values, or to lists of them for flags that may be repeated.
+func readConfig(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := map[string][]string{}
+	key := ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if key == "" || line == trimmed {
+				return nil, fmt.Errorf("Invalid line %d in %s: list item without a key", n, path)
+			}
+			value, err := configValue(strings.TrimPrefix(trimmed, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid line %d in %s: %v", n, path, err)
+			}
+			config[key] = append(config[key], value)
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || line != trimmed || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid line %d in %s: must be key: value", n, path)
+		}
+		key = strings.TrimSpace(parts[0])
+		if _, ok := config[key]; ok {
+			return nil, fmt.Errorf("Invalid line %d in %s: duplicate key %s", n, path, key)
+		}
+		config[key] = nil
+
+		value := strings.TrimSpace(parts[1])
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			for _, item := range strings.Split(strings.Trim(value, "[]"), ",") {
+				if strings.TrimSpace(item) == "" {
+					continue
+				}
+				v, err := configValue(item)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid line %d in %s: %v", n, path, err)
+				}
+				config[key] = append(config[key], v)
+			}
+			continue
+		}
+		if value != "" && !strings.HasPrefix(value, "#") {
+			v, err := configValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid line %d in %s: %v", n, path, err)
+			}
+			config[key] = []string{v}
+		}
+	}
+
+	return config, scanner.Err()
+}
+
+func configValue(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.Replace(value[1:end], "''", "'", -1), nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
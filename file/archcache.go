@@ -0,0 +1,88 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ArchCache enables caching the OS and architecture of the Docker daemon
+// between invocations, so quick commands don't have to wait for docker version.
+var ArchCache = true
+
+const archCacheTTL = 10 * time.Minute
+
+// archCacheFile returns the cache file for the current Docker daemon, keyed
+// by DOCKER_HOST and the docker context so switching either misses the cache.
+func archCacheFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	key := strings.Join([]string{os.Getenv("DOCKER_HOST"), os.Getenv("DOCKER_CONTEXT"), dockerContext()}, "\x00")
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, "dapper", fmt.Sprintf("host-platform-%x", sum[:8])), nil
+}
+
+// dockerContext returns the current context from the docker CLI config.
+func dockerContext() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return ""
+	}
+	config := struct {
+		CurrentContext string `json:"currentContext"`
+	}{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return ""
+	}
+	return config.CurrentContext
+}
+
+// readArchCache returns the cached os/arch of the Docker daemon.
+func readArchCache() (string, bool) {
+	file, err := archCacheFile()
+	if err != nil {
+		return "", false
+	}
+	fi, err := os.Stat(file)
+	if err != nil || time.Since(fi.ModTime()) > archCacheTTL {
+		return "", false
+	}
+	content, err := ioutil.ReadFile(file)
+	platform := strings.TrimSpace(string(content))
+	if err != nil || !strings.Contains(platform, "/") {
+		return "", false
+	}
+	logrus.Debugf("Using host platform %s cached in %s", platform, file)
+	return platform, true
+}
+
+func writeArchCache(platform string) {
+	file, err := archCacheFile()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(file), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(file, []byte(platform+"\n"), 0644)
+	}
+	if err != nil {
+		logrus.Debugf("Failed to cache host platform: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package file
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Artifact is a file copied back to the host, as listed in the manifest file.
+type Artifact struct {
+	// Path is the path of the file on the host
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// copyStream copies back an output entry like docker cp, but reads the tar
+// stream of docker cp to stdout and extracts it here, so each file written is
+// recorded for the manifest file with the checksum computed as it is copied.
+func (d *Dapperfile) copyStream(container string, e CopyEntry) error {
+	logrus.Infof("docker cp %s %s", e.Source, e.Destination)
+	cmd := d.command(d.docker, "cp", container+":"+e.Source, "-")
+	cmd.Env = d.environ()
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to copy back %s: %v", e.Output, err)
+	}
+
+	extractErr := d.extract(stdout, e.Destination)
+	if extractErr != nil {
+		// let docker finish writing so it exits
+		io.Copy(ioutil.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("Failed to copy back %s: %v", e.Output, err)
+	}
+	if extractErr != nil {
+		return fmt.Errorf("Failed to copy back %s: %v", e.Output, extractErr)
+	}
+	return nil
+}
+
+// extract writes the tar stream of docker cp into dest, relative to the base
+// directory, and records the regular files as artifacts by their path under
+// dest. Entries may not leave dest, including through symlinks extracted
+// earlier.
+func (d *Dapperfile) extract(r io.Reader, dest string) error {
+	dir := d.path(dest)
+	sums := map[string]Artifact{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name, err := extractPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, name)
+		mode := hdr.FileInfo().Mode()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			artifact, err := extractFile(tr, target, mode.Perm())
+			if err != nil {
+				return err
+			}
+			artifact.Path = filepath.ToSlash(filepath.Join(dest, name))
+			sums[name] = artifact
+			d.artifacts = append(d.artifacts, artifact)
+		case tar.TypeLink:
+			link, err := extractPath(dir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := replace(target); err != nil {
+				return err
+			}
+			if err := os.Link(filepath.Join(dir, link), target); err != nil {
+				return err
+			}
+			if artifact, ok := sums[link]; ok {
+				artifact.Path = filepath.ToSlash(filepath.Join(dest, name))
+				d.artifacts = append(d.artifacts, artifact)
+			}
+		case tar.TypeSymlink:
+			if err := replace(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			logrus.Debugf("Not copying back %s, unsupported file type %c", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// extractPath returns the path of a tar entry relative to dir, checking that
+// it stays inside dir.
+func extractPath(dir, name string) (string, error) {
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || path.IsAbs(clean) || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path %q in docker cp output", name)
+	}
+	rel := filepath.FromSlash(clean)
+
+	parent := dir
+	for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		parent = filepath.Join(parent, part)
+		if fi, err := os.Lstat(parent); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Invalid path %q in docker cp output, %s is a symlink", name, parent)
+		}
+	}
+	return rel, nil
+}
+
+// replace removes target, unless it is a directory, so it can be written
+// without following a symlink that was there.
+func replace(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+		return os.Remove(target)
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, target string, perm os.FileMode) (Artifact, error) {
+	if err := replace(target); err != nil {
+		return Artifact{}, err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return Artifact{}, err
+	}
+	return Artifact{
+		Path:   filepath.ToSlash(target),
+		Size:   size,
+		SHA256: fmt.Sprintf("%x", h.Sum(nil)),
+	}, f.Close()
+}
+
+// writeManifestFile writes the files copied back in this run to ManifestFile.
+func (d *Dapperfile) writeManifestFile() error {
+	latest := map[string]Artifact{}
+	for _, a := range d.artifacts {
+		latest[a.Path] = a
+	}
+	artifacts := make([]Artifact, 0, len(latest))
+	for _, a := range latest {
+		artifacts = append(artifacts, a)
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].Path < artifacts[j].Path
+	})
+
+	content, err := json.MarshalIndent(artifacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Writing %d artifacts to %s", len(artifacts), d.ManifestFile)
+	return ioutil.WriteFile(d.path(d.ManifestFile), append(content, '\n'), 0644)
+}
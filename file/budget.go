@@ -0,0 +1,62 @@
+package file
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+func (d *Dapperfile) maxImageSize() string {
+	if d.MaxImageSize != "" {
+		return d.MaxImageSize
+	}
+	return d.env.MaxImageSize()
+}
+
+func (d *Dapperfile) maxLayers() (int, error) {
+	if d.MaxLayers > 0 {
+		return d.MaxLayers, nil
+	}
+	return d.env.MaxLayers()
+}
+
+// checkImageBudget fails the build if the image is larger than the maximum
+// size or has more layers than allowed. The limits come from the flags, or
+// else from the image if its environment has been read.
+func (d *Dapperfile) checkImageBudget(tag string) error {
+	var maxSize int64
+	if size := d.maxImageSize(); size != "" {
+		var err error
+		if maxSize, err = parseSize(size); err != nil {
+			return fmt.Errorf("Invalid max image size %q: %v", size, err)
+		}
+	}
+	maxLayers, err := d.maxLayers()
+	if err != nil {
+		return err
+	}
+	if maxSize == 0 && maxLayers == 0 {
+		return nil
+	}
+
+	output, err := d.execWithOutput("image", "inspect", "-f", "{{.Size}} {{len .RootFS.Layers}}", tag)
+	if err != nil {
+		return fmt.Errorf("Failed to inspect image %s: %v: %s", tag, err, strings.TrimSpace(string(output)))
+	}
+	var size int64
+	var layers int
+	if _, err := fmt.Sscan(string(output), &size, &layers); err != nil {
+		return fmt.Errorf("Failed to read the size of image %s: %v", tag, err)
+	}
+	logrus.Debugf("Image %s is %d bytes with %d layers", tag, size, layers)
+
+	if maxSize > 0 && size > maxSize {
+		return fmt.Errorf("%w: image %s is %d bytes, larger than the maximum of %s", ErrBuildFailed, tag, size, d.maxImageSize())
+	}
+	if maxLayers > 0 && layers > maxLayers {
+		return fmt.Errorf("%w: image %s has %d layers, more than the maximum of %d, check the Dockerfile for RUN, COPY "+
+			"and ADD instructions that can be combined", ErrBuildFailed, tag, layers, maxLayers)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeDebugBundle writes what goes into the build to files in dir, for
+// attaching to bug reports. Values of secret build args and of variables that
+// look like credentials are redacted.
+func (d *Dapperfile) writeDebugBundle(dir, tag string, dapperFile []byte, args []string) error {
+	dir = d.path(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Failed to create debug bundle: %v", err)
+	}
+
+	secrets := d.secretArgs()
+	buildArgs := []string{}
+	for _, v := range d.Args {
+		buildArgs = append(buildArgs, redact(v, secrets))
+	}
+
+	buildFile := d.File
+	if d.NoContext {
+		buildFile = ""
+	}
+
+	goos, arch := d.targetOSArch()
+	settings := []string{
+		"file=" + d.File,
+		"mode=" + d.Mode,
+		"tag=" + tag,
+		"target=" + d.Target,
+		"platform=" + d.platform(),
+		"target-arch=" + goos + "/" + arch,
+		"host-arch=" + d.hostOS + "/" + d.hostArch,
+		fmt.Sprintf("buildkit=%t", d.isBuildKit()),
+	}
+
+	command := d.buildCommand(tag, buildFile, args)
+	for i := 1; i < len(command); i++ {
+		if command[i-1] == "--build-arg" {
+			command[i] = redact(command[i], secrets)
+		}
+	}
+
+	files := map[string][]byte{
+		"Dockerfile":   dapperFile,
+		"args.txt":     lines(buildArgs),
+		"settings.txt": lines(settings),
+		"command.txt":  lines([]string{strings.Join(append([]string{"docker"}, command...), " ")}),
+	}
+
+	if output, err := d.execWithOutput("image", "inspect", "-f", "{{json .Config.Env}}", tag); err == nil {
+		var env []string
+		if err := json.Unmarshal(output, &env); err != nil {
+			logrus.Debugf("Not writing image-env.json: %v", err)
+		} else {
+			for i, v := range env {
+				env[i] = redact(v, secrets)
+			}
+			if files["image-env.json"], err = json.MarshalIndent(env, "", "  "); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			return fmt.Errorf("Failed to write debug bundle: %v", err)
+		}
+	}
+
+	logrus.Infof("Wrote debug bundle to %s", dir)
+	return nil
+}
+
+// sensitiveNames are the parts of variable names whose values are redacted
+// from the debug bundle.
+var sensitiveNames = []string{"TOKEN", "PASSWORD", "SECRET"}
+
+// redact replaces the value of a NAME=value entry with <redacted> if NAME is
+// a secret build arg or looks like it holds a credential.
+func redact(v string, secrets map[string]bool) string {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 {
+		return v
+	}
+	redacted := secrets[kv[0]]
+	for _, s := range sensitiveNames {
+		redacted = redacted || strings.Contains(strings.ToUpper(kv[0]), s)
+	}
+	if redacted {
+		return kv[0] + "=<redacted>"
+	}
+	return v
+}
+
+func lines(values []string) []byte {
+	if len(values) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(values, "\n") + "\n")
+}
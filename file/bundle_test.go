@@ -0,0 +1,26 @@
+package file
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	secrets := map[string]bool{"NPM_AUTH": true}
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"VERSION=1.2", "VERSION=1.2"},
+		{"NPM_AUTH=abc", "NPM_AUTH=<redacted>"},
+		{"GITHUB_TOKEN=abc", "GITHUB_TOKEN=<redacted>"},
+		{"db_password=abc", "db_password=<redacted>"},
+		{"CI_SECRET_KEY=abc", "CI_SECRET_KEY=<redacted>"},
+		{"TOKEN", "TOKEN"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := redact(tt.value, secrets); got != tt.want {
+				t.Errorf("redact(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package file
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var cacheTypes = map[string]bool{
+	"registry": true,
+	"local":    true,
+	"gha":      true,
+	"s3":       true,
+	"azblob":   true,
+}
+
+// checkCacheSpecs validates --cache-from style specs and drops duplicates.
+// A spec without any key=value pairs is an image reference, which docker
+// treats as type=registry,ref=<image>.
+func checkCacheSpecs(specs []string) ([]string, error) {
+	seen := map[string]string{}
+	result := []string{}
+
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		key, err := parseCacheSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if prev, ok := seen[key]; ok {
+			logrus.Warnf("Ignoring cache spec %q, it duplicates %q", spec, prev)
+			continue
+		}
+		seen[key] = spec
+		result = append(result, spec)
+	}
+
+	return result, nil
+}
+
+func parseCacheSpec(spec string) (string, error) {
+	if spec == "" {
+		return "", fmt.Errorf("Invalid cache spec: must not be empty")
+	}
+
+	if !strings.Contains(spec, "=") {
+		return "ref=" + spec + ",type=registry", nil
+	}
+
+	attrs := map[string]string{}
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", fmt.Errorf("Invalid cache spec %q: %q is not of the form key=value", spec, field)
+		}
+		if _, ok := attrs[kv[0]]; ok {
+			return "", fmt.Errorf("Invalid cache spec %q: %s is set more than once", spec, kv[0])
+		}
+		attrs[kv[0]] = kv[1]
+	}
+
+	t, ok := attrs["type"]
+	if !ok {
+		return "", fmt.Errorf("Invalid cache spec %q: missing type=", spec)
+	}
+	if t == "inline" {
+		return "", fmt.Errorf("Invalid cache spec %q: inline is only a cache export type, "+
+			"use the image reference or type=registry to import an inline cache", spec)
+	}
+	if !cacheTypes[t] {
+		return "", fmt.Errorf("Invalid cache spec %q: unknown type %s", spec, t)
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for k, v := range attrs {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ","), nil
+}
@@ -0,0 +1,48 @@
+package file
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkChanges returns ErrNoChanges if none of the files matching WatchPaths
+// changed since the ChangedSince git ref. Outside a git repository it always
+// builds.
+func (d *Dapperfile) checkChanges() error {
+	if d.ChangedSince == "" {
+		return nil
+	}
+
+	if d.gitOutput("rev-parse", "--is-inside-work-tree") != "true" {
+		logrus.Warnf("Ignoring --changed-since, %s is not in a git repository", d.File)
+		return nil
+	}
+
+	// --relative makes the names relative to, and limits them to, the
+	// base directory
+	output, err := d.command("git", "diff", "--name-only", "--relative", d.ChangedSince).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to list files changed since %s: %v", d.ChangedSince, err)
+	}
+
+	patterns := []string{}
+	for _, p := range d.WatchPaths {
+		patterns = append(patterns, strings.Trim(filepath.ToSlash(filepath.Clean(p)), "/"))
+	}
+
+	for _, file := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if file == "" {
+			continue
+		}
+		if len(patterns) == 0 || matchesAny(file, patterns) {
+			logrus.Debugf("Building, %s changed since %s", file, d.ChangedSince)
+			return nil
+		}
+	}
+
+	logrus.Infof("Skipping build, nothing in %v changed since %s", d.WatchPaths, d.ChangedSince)
+	return ErrNoChanges
+}
@@ -0,0 +1,88 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+type cleanup struct {
+	name      string
+	onFailure bool
+	fn        func() error
+}
+
+func (d *Dapperfile) addCleanup(name string, fn func() error) {
+	d.cleanups = append(d.cleanups, cleanup{name: name, fn: fn})
+}
+
+func (d *Dapperfile) addFailureCleanup(name string, fn func() error) {
+	d.cleanups = append(d.cleanups, cleanup{name: name, onFailure: true, fn: fn})
+}
+
+// runCleanup deletes the named item right away rather than at the end.
+func (d *Dapperfile) runCleanup(name string) {
+	for i, c := range d.cleanups {
+		if c.name != name {
+			continue
+		}
+		d.cleanups = append(d.cleanups[:i], d.cleanups[i+1:]...)
+		logrus.Debugf("Deleting %s", c.name)
+		if err := c.fn(); err != nil {
+			logrus.Errorf("Failed to delete %s: %v", c.name, err)
+		}
+		return
+	}
+}
+
+func (d *Dapperfile) cleanup(failed bool) {
+	cleanups := d.cleanups
+	d.cleanups = nil
+
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		c := cleanups[i]
+		switch {
+		case c.onFailure && !failed:
+			continue
+		case failed && d.NoCleanupOnFailure:
+			logrus.Infof("Not deleting %s", c.name)
+			continue
+		}
+
+		logrus.Debugf("Deleting %s", c.name)
+		if err := c.fn(); err != nil {
+			logrus.Errorf("Failed to delete %s: %v", c.name, err)
+		}
+	}
+}
+
+// teardown runs the --teardown command after a run and its cleanup, whether
+// or not the run failed. Its own failure is only logged.
+func (d *Dapperfile) teardown(tag, container string, failed bool) {
+	if d.Teardown == "" {
+		return
+	}
+
+	cmd := d.command("/bin/sh", "-c", d.Teardown)
+	if runtime.GOOS == "windows" {
+		cmd = d.command("cmd", "/C", d.Teardown)
+	}
+	cmd.Env = append(os.Environ(),
+		"DAPPER_TAG="+tag,
+		"DAPPER_CONTAINER="+container,
+		fmt.Sprintf("DAPPER_FAILED=%t", failed))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	logrus.Debugf("Running teardown %s", d.Teardown)
+	if err := cmd.Run(); err != nil {
+		logrus.Errorf("Teardown %q failed: %v", d.Teardown, err)
+	}
+}
+
+func (d *Dapperfile) Close() error {
+	d.cleanup(false)
+	return nil
+}
@@ -0,0 +1,190 @@
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func LookupContext(dir string, context io.Reader, file, tempDir string) (*Dapperfile, error) {
+	d := &Dapperfile{
+		File:    file,
+		Dir:     dir,
+		TempDir: tempDir,
+	}
+
+	if err := d.spoolContext(context); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	if err := d.init(); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *Dapperfile) spoolContext(context io.Reader) error {
+	dir, err := d.tempDir()
+	if err != nil {
+		return err
+	}
+
+	spool, err := ioutil.TempFile(dir, "dapper-context")
+	if err != nil {
+		return fmt.Errorf("Failed to create tempfile in %s: %v", dir, err)
+	}
+	defer spool.Close()
+	d.contextTar = spool.Name()
+	d.addCleanup("build context "+d.contextTar, func() error {
+		return os.Remove(d.contextTar)
+	})
+
+	logrus.Debugf("Reading build context into %s", d.contextTar)
+
+	input := io.TeeReader(context, spool)
+	tr := tar.NewReader(input)
+	name := path.Clean(filepath.ToSlash(d.File))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to read build context: %v", err)
+		}
+
+		if path.Clean(header.Name) == name {
+			if d.contextFile, err = ioutil.ReadAll(tr); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := io.Copy(ioutil.Discard, input); err != nil {
+		return err
+	}
+
+	if d.contextFile == nil {
+		return fmt.Errorf("%s not found in build context", d.File)
+	}
+
+	return nil
+}
+
+func (d *Dapperfile) contextDockerfile() string {
+	return fmt.Sprintf("%s-%s", path.Base(filepath.ToSlash(d.File)), randString())
+}
+
+func (d *Dapperfile) buildFromContext(name string, content []byte, args ...string) error {
+	f, err := os.Open(d.contextTar)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		pw.CloseWithError(appendToTar(pw, f, name, content))
+	}()
+
+	return d.execWithStdin(pr, args...)
+}
+
+func appendToTar(w io.Writer, r io.Reader, name string, content []byte) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, bytes.NewReader(content)); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// checkCompress logs the size of the build context before docker compresses
+// it. The size is found by walking the context without reading the files;
+// docker reports the compressed size it sends.
+func (d *Dapperfile) checkCompress() {
+	if d.isBuildKit() {
+		logrus.Warnf("--compress-context has no effect with BuildKit, which only sends the files the build uses")
+		return
+	}
+
+	if d.contextTar != "" {
+		if fi, err := os.Stat(d.contextTar); err == nil {
+			logrus.Infof("Compressing a build context of %d bytes", fi.Size())
+		}
+		return
+	}
+
+	ignores, err := readIgnores(d.path(".dockerignore"))
+	if err != nil {
+		logrus.Debugf("Not measuring the build context: %v", err)
+		return
+	}
+
+	var size int64
+	root := d.path(".")
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if matchesAny(filepath.ToSlash(rel), ignores) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Debugf("Not measuring the build context: %v", err)
+		return
+	}
+	logrus.Infof("Compressing a build context of %d bytes", size)
+}
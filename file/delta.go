@@ -0,0 +1,141 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// copyOutput copies back an output entry from the build container in full.
+// With a manifest file the copy is streamed, to record what was written.
+func (d *Dapperfile) copyOutput(container string, e CopyEntry) error {
+	if d.ManifestFile != "" {
+		return d.copyStream(container, e)
+	}
+	logrus.Infof("docker cp %s %s", e.Source, e.Destination)
+	if err := d.exec("cp", container+":"+e.Source, e.Destination); err != nil {
+		return fmt.Errorf("Failed to copy back %s: %v", e.Output, err)
+	}
+	return nil
+}
+
+// copyDelta copies back only the files of an output directory that differ
+// from the host copy, found by comparing against a manifest of checksums made
+// in a throwaway container. It falls back to a full copy if the host copy does
+// not exist or the manifest can not be made.
+func (d *Dapperfile) copyDelta(container string, e CopyEntry) error {
+	target := filepath.Join(e.Destination, path.Base(e.Source))
+	if fi, err := os.Stat(d.path(target)); err != nil || !fi.IsDir() {
+		return d.copyOutput(container, e)
+	}
+
+	manifest, err := d.outputManifest(container, e.Source)
+	if err != nil {
+		logrus.Warnf("Copying back all of %s, failed to list changed files: %v", e.Output, err)
+		return d.copyOutput(container, e)
+	}
+
+	files := make([]string, 0, len(manifest))
+	for p := range manifest {
+		files = append(files, p)
+	}
+	sort.Strings(files)
+
+	changed := 0
+	for _, p := range files {
+		local := filepath.Join(target, filepath.FromSlash(p))
+		if sum, err := fileSHA256(d.path(local)); err == nil && sum == manifest[p] {
+			d.addArtifact(local, manifest[p])
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(d.path(local)), 0755); err != nil {
+			return err
+		}
+		logrus.Debugf("docker cp %s %s", path.Join(e.Source, p), local)
+		if err := d.exec("cp", container+":"+path.Join(e.Source, p), local); err != nil {
+			return fmt.Errorf("Failed to copy back %s: %v", path.Join(e.Output, p), err)
+		}
+		d.addArtifact(local, manifest[p])
+		changed++
+	}
+	logrus.Infof("Copied back %d of %d files in %s", changed, len(files), e.Output)
+	return nil
+}
+
+// addArtifact records a file copied back by copyDelta, whose checksum is the
+// one computed in the container.
+func (d *Dapperfile) addArtifact(local, sum string) {
+	if d.ManifestFile == "" {
+		return
+	}
+	fi, err := os.Stat(d.path(local))
+	if err != nil {
+		logrus.Warnf("Not listing %s in %s: %v", local, d.ManifestFile, err)
+		return
+	}
+	d.artifacts = append(d.artifacts, Artifact{
+		Path:   filepath.ToSlash(local),
+		Size:   fi.Size(),
+		SHA256: sum,
+	})
+}
+
+// fileSHA256 returns the sha256 of the content of a file.
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// outputManifest returns the sha256 of each file under dir in the stopped
+// container, by path relative to dir. The container has exited, so docker exec
+// can not be used; instead it is committed to a temporary image and the
+// checksums are computed in a throwaway container. The commit writes a layer
+// with every file the command changed, which is the cost of a delta copy.
+func (d *Dapperfile) outputManifest(container, dir string) (map[string]string, error) {
+	committed, err := d.execWithOutput("commit", container)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to commit container %s: %v: %s", container, err, strings.TrimSpace(string(committed)))
+	}
+	image := strings.TrimSpace(string(committed))
+	defer func() {
+		if _, err := d.execWithOutput("rmi", image); err != nil {
+			logrus.Debugf("Error deleting manifest image %s: %s", image, err)
+		}
+	}()
+
+	out, err := d.execWithOutput("run", "--rm", "--network", "none", "--entrypoint", "sh", image,
+		"-c", `cd "$1" && find . -type f -exec sha256sum {} +`, "sh", dir)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	manifest := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// sha256sum prints the checksum, two spaces and the path
+		parts := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(parts) != 2 || len(parts[0]) != 64 {
+			return nil, fmt.Errorf("Unexpected sha256sum output %q", scanner.Text())
+		}
+		manifest[path.Clean(parts[1])] = parts[0]
+	}
+	return manifest, scanner.Err()
+}
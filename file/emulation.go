@@ -0,0 +1,78 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// archNames maps the architecture names docker uses to the other names tools
+// print for them. The first name is the one QEMU uses.
+var archNames = map[string][]string{
+	"amd64":    {"x86_64", "x86-64"},
+	"arm64":    {"aarch64"},
+	"arm":      {"arm", "armv7l", "armhf"},
+	"386":      {"i386", "i686"},
+	"mips64le": {"mips64el"},
+	"ppc64le":  {"ppc64le", "ppc64el"},
+}
+
+// qemuArch returns the QEMU name of a docker architecture.
+func qemuArch(arch string) string {
+	if names, ok := archNames[arch]; ok {
+		return names[0]
+	}
+	return arch
+}
+
+// dockerArch returns the docker name of an architecture given by any of its
+// names.
+func dockerArch(name string) string {
+	for arch, names := range archNames {
+		for _, n := range names {
+			if n == name {
+				return arch
+			}
+		}
+	}
+	return name
+}
+
+// runOSArch is the platform of the build container, which is the build
+// platform unless --run-platform is given.
+func (d *Dapperfile) runOSArch() (string, string) {
+	if parts := strings.Split(d.RunPlatform, "/"); len(parts) > 1 {
+		return parts[0], parts[1]
+	}
+	return d.targetOSArch()
+}
+
+func (d *Dapperfile) checkEmulation() error {
+	_, arch := d.runOSArch()
+	if d.NoEmulationCheck || arch == "" || runtime.GOOS != "linux" {
+		return nil
+	}
+
+	// binfmt_misc is only visible here when the daemon runs on this host
+	if host := os.Getenv("DOCKER_HOST"); host != "" && !strings.HasPrefix(host, "unix://") {
+		logrus.Debugf("Skipping emulation check for remote daemon %s", host)
+		return nil
+	}
+
+	daemonArch := d.daemonArch()
+	if arch == daemonArch || (arch == "386" && daemonArch == "amd64") {
+		return nil
+	}
+
+	binfmt := "/proc/sys/fs/binfmt_misc/qemu-" + qemuArch(arch)
+	if _, err := os.Stat(binfmt); err != nil {
+		return fmt.Errorf("Running %s images on a %s host requires QEMU emulation but %s is not registered, "+
+			"run 'docker run --privileged --rm tonistiigi/binfmt --install %s' or pass --no-emulation-check", arch, daemonArch, binfmt, arch)
+	}
+
+	logrus.Debugf("Running %s images using %s", arch, binfmt)
+	return nil
+}
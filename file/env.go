@@ -1,15 +1,22 @@
 package file
 
 import (
+	"fmt"
+	"path"
+	"strconv"
 	"strings"
 )
 
+// EnvPrefix is the prefix of the image variables that configure dapper. The
+// accessors below use the default names, readEnv maps other prefixes to them.
+var EnvPrefix = "DAPPER_"
+
 type Context map[string]string
 
 func (c Context) Source() string {
 	source := "/source/"
 	if v, ok := c["DAPPER_SOURCE"]; ok && v != "" {
-		source = v
+		source = path.Clean(v)
 	}
 
 	if !strings.HasSuffix(source, "/") {
@@ -19,13 +26,39 @@ func (c Context) Source() string {
 	return source
 }
 
+// Cp is normalized without a trailing slash. Combined with the trailing
+// slash on Source, a directory is copied as its contents into the
+// destination directory however the image declared either value.
 func (c Context) Cp() string {
 	if v, ok := c["DAPPER_CP"]; ok && v != "" {
-		return v
+		return path.Clean(v)
 	}
 	return "."
 }
 
+// CpBase is the image to also copy the source into in CP mode, if any.
+func (c Context) CpBase(base string) string {
+	if base != "" {
+		return base
+	}
+	return c["DAPPER_CP_BASE"]
+}
+
+func (c Context) CpChmod() string {
+	return strings.TrimSpace(c["DAPPER_CP_CHMOD"])
+}
+
+func (c Context) CpExclude() []string {
+	ret := []string{}
+	for _, i := range strings.Split(c["DAPPER_CP_EXCLUDE"], ",") {
+		i = strings.TrimSpace(i)
+		if i != "" {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
 func (c Context) Socket() bool {
 	if v, ok := c["DAPPER_DOCKER_SOCKET"]; ok && v != "" {
 		return "true" == v
@@ -41,6 +74,63 @@ func (c Context) Mode(mode string) string {
 	return "cp"
 }
 
+func (c Context) Home() string {
+	if v, ok := c["HOME"]; ok && v != "" {
+		return v
+	}
+	return "/root"
+}
+
+func (c Context) Gpus() string {
+	return strings.TrimSpace(c["DAPPER_RUN_GPUS"])
+}
+
+func (c Context) ShmSize() string {
+	return strings.TrimSpace(c["DAPPER_RUN_SHM_SIZE"])
+}
+
+func (c Context) MaxImageSize() string {
+	return strings.TrimSpace(c["DAPPER_MAX_IMAGE_SIZE"])
+}
+
+func (c Context) MaxLayers() (int, error) {
+	v := strings.TrimSpace(c["DAPPER_MAX_LAYERS"])
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid DAPPER_MAX_LAYERS %q: must be a number of layers", v)
+	}
+	return n, nil
+}
+
+// Sysctls splits DAPPER_RUN_SYSCTL into key=value pairs. A word without an =
+// continues the value before it, since some values contain spaces.
+func (c Context) Sysctls() []string {
+	ret := []string{}
+	for _, i := range strings.Fields(c["DAPPER_RUN_SYSCTL"]) {
+		if !strings.Contains(i, "=") && len(ret) > 0 {
+			ret[len(ret)-1] += " " + i
+			continue
+		}
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+func (c Context) LogDriver() string {
+	return strings.TrimSpace(c["DAPPER_RUN_LOG_DRIVER"])
+}
+
+func (c Context) LogOpts() []string {
+	return strings.Fields(c["DAPPER_RUN_LOG_OPT"])
+}
+
+func (c Context) GroupAdd() []string {
+	return strings.FieldsFunc(c["DAPPER_RUN_GROUP_ADD"], func(r rune) bool { return r == ',' || r == ' ' })
+}
+
 func (c Context) Env() []string {
 	val := []string{}
 	if v, ok := c["DAPPER_ENV"]; ok && v != "" {
@@ -59,6 +149,14 @@ func (c Context) Env() []string {
 	return ret
 }
 
+func (c Context) Inject() []string {
+	ret := []string{}
+	for _, i := range strings.FieldsFunc(c["DAPPER_INJECT"], func(r rune) bool { return r == ',' || r == ' ' }) {
+		ret = append(ret, strings.ToLower(i))
+	}
+	return ret
+}
+
 func (c Context) Shell() string {
 	if shell, ok := c["SHELL"]; ok && shell != "" {
 		return shell
@@ -80,6 +178,10 @@ func (c Context) Output() []string {
 	return []string{}
 }
 
+func (c Context) DefaultCmd() []string {
+	return strings.Fields(c["DAPPER_RUN_CMD"])
+}
+
 func (c Context) RunArgs() []string {
 	if v, ok := c["DAPPER_RUN_ARGS"]; ok {
 		ret := []string{}
@@ -0,0 +1,29 @@
+package file
+
+import "testing"
+
+func TestContextSourceAndCp(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    Context
+		source string
+		cp     string
+	}{
+		{"defaults", Context{}, "/source/", "."},
+		{"no trailing slashes", Context{"DAPPER_SOURCE": "/go/src/app", "DAPPER_CP": "src"}, "/go/src/app/", "src"},
+		{"trailing slashes", Context{"DAPPER_SOURCE": "/go/src/app/", "DAPPER_CP": "src/"}, "/go/src/app/", "src"},
+		{"repeated slashes", Context{"DAPPER_SOURCE": "/go/src/app//", "DAPPER_CP": "./src//"}, "/go/src/app/", "src"},
+		{"current directory", Context{"DAPPER_CP": "./"}, "/source/", "."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.env.Source(); got != tt.source {
+				t.Errorf("Source() = %q, want %q", got, tt.source)
+			}
+			if got := tt.env.Cp(); got != tt.cp {
+				t.Errorf("Cp() = %q, want %q", got, tt.cp)
+			}
+		})
+	}
+}
@@ -14,3 +14,10 @@ func (c Context) HostSocket() string {
 	}
 	return "/var/run/docker.sock"
 }
+
+func (c Context) SocketPath() string {
+	if v, ok := c["DAPPER_SOCKET_PATH"]; ok && v != "" {
+		return v
+	}
+	return "/var/run/docker.sock"
+}
@@ -12,3 +12,10 @@ func (c Context) HostSocket() string {
 	}
 	return "//./pipe/docker_engine"
 }
+
+func (c Context) SocketPath() string {
+	if v, ok := c["DAPPER_SOCKET_PATH"]; ok && v != "" {
+		return v
+	}
+	return "//./pipe/docker_engine"
+}
@@ -1,83 +1,201 @@
 package file
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/sirupsen/logrus"
 )
 
+const maxBuildArgFileSize = 64 * 1024
+
 var (
-	re           = regexp.MustCompile("[^a-zA-Z0-9]")
-	ErrSkipBuild = errors.New("skip build")
+	re               = regexp.MustCompile("[^a-zA-Z0-9]")
+	octalMode        = regexp.MustCompile("^[0-7]{3,4}$")
+	ErrSkipBuild     = errors.New("skip build")
+	ErrDockerMissing = errors.New("docker not found")
+	ErrBuildFailed   = errors.New("build failed")
+	ErrOutputCopy    = errors.New("copying output failed")
+	ErrTimeout       = errors.New("timed out")
+
+	// ErrNoChanges is returned, wrapping ErrSkipBuild, when --changed-since
+	// finds no changes to the watched paths.
+	ErrNoChanges = fmt.Errorf("%w: no watched paths changed", ErrSkipBuild)
 )
 
 type Dapperfile struct {
-	File        string
-	Mode        string
-	docker      string
-	env         Context
-	Socket      bool
-	NoOut       bool
-	Args        []string
-	From        string
-	Quiet       bool
-	hostArch    string
-	Keep        bool
-	NoContext   bool
-	MountSuffix string
-	Target      string
-}
-
-func Lookup(file string) (*Dapperfile, error) {
-	if _, err := os.Stat(file); err != nil {
-		return nil, err
-	}
+	File               string
+	Dir                string
+	Mode               string
+	docker             string
+	env                Context
+	Socket             bool
+	NoOut              bool
+	Args               []string
+	From               string
+	Quiet              bool
+	hostArch           string
+	hostOS             string
+	Keep               bool
+	NoContext          bool
+	MountSuffix        string
+	Target             string
+	Prepull            bool
+	NoIDEnv            bool
+	TempDir            string
+	Gpus               string
+	MountGit           bool
+	Output             []string
+	OutputOnly         []string
+	Rm                 bool
+	CacheFrom          []string
+	Platform           string
+	SecretArgs         []string
+	ShellArgs          []string
+	NoEmulationCheck   bool
+	BuildArgFiles      []string
+	NoCleanupOnFailure bool
+	CleanupImage       bool
+	ReadOnly           bool
+	Incremental        bool
+	IncrementalGlobs   []string
+	Force              bool
+	IIDFile            string
+	ImageID            string
+	Tag                string
+	Labels             []string
+	MountTimezone      bool
+	Timeout            time.Duration
+	DockerfileSyntax   string
+	BuildMounts        []string
+	CpBase             string
+	GroupAdd           []string
+	SocketGroup        bool
+	ShmSize            string
+	RunExisting        bool
+	RunLabels          []string
+	StrictArch         bool
+	CleanEnv           bool
+	CleanEnvAllow      []string
+	MountCA            string
+	Teardown           string
+	TagFile            string
+	CompressContext    bool
+	CacheMounts        []string
+	BuildOnly          bool
+	DebugBundle        string
+	RunRetries         int
+	RetryOn            []int
+	OutputMount        string
+	RunPlatform        string
+	ChangedSince       string
+	WatchPaths         []string
+	NoSocket           bool
+	Frontend           string
+	DeltaCopy          bool
+	StopSignal         string
+	StopTimeout        time.Duration
+	InlineCache        bool
+	ManifestFile       string
+	AutoLabel          bool
+	NoAutoLabel        []string
+	MaxImageSize       string
+	MaxLayers          int
+	VerifyTarget       string
+	directives         map[string][]string
+	cleanups           []cleanup
+	buildKit           *bool
+	archCmd            *string
+	daemon             string
+	caContextPath      string
+	baseArgs           []string
+	contextTar         string
+	contextFile        []byte
+	artifacts          []Artifact
+	expandedTag        string
+	expandedLabels     []string
+	autoLabelValues    []string
+
+	// ArgsHook, if set, is called with the build args before building and
+	// returns the build args to use.
+	ArgsHook func(map[string]string) map[string]string
+}
 
+func Lookup(dir, file string) (*Dapperfile, error) {
 	d := &Dapperfile{
 		File: file,
+		Dir:  dir,
+	}
+	if _, err := os.Stat(d.path(file)); err != nil {
+		return nil, err
 	}
 
 	return d, d.init()
 }
 
-func (d *Dapperfile) init() error {
+func (d *Dapperfile) lookupDocker() error {
 	docker, err := exec.LookPath("docker")
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrDockerMissing, err)
 	}
 	d.docker = docker
-	if d.Args, err = d.argsFromEnv(d.File); err != nil {
+	return nil
+}
+
+func (d *Dapperfile) init() error {
+	err := d.lookupDocker()
+	if err != nil {
+		return err
+	}
+	if d.directives, err = d.readDirectives(); err != nil {
+		return err
+	}
+	if err := d.checkRequires(); err != nil {
+		return err
+	}
+	if d.Args, err = d.argsFromEnv(); err != nil {
 		return err
 	}
 	if d.hostArch == "" {
 		d.hostArch = d.findHostArch()
 	}
+	if d.hostOS == "" {
+		d.hostOS = d.findHostOS()
+	}
 	return nil
 }
 
-func (d *Dapperfile) argsFromEnv(dockerfile string) ([]string, error) {
-	file, err := os.Open(dockerfile)
+func (d *Dapperfile) argsFromEnv() ([]string, error) {
+	file, err := d.openFile()
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	scanner := d.newScanner(file)
 	r := []string{}
+	// an ARG without a value from the environment, which a following
+	// "# ARG GIT_CONFIG:<key>" comment can fill in from git config
+	unset := ""
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		fields := strings.Fields(line)
@@ -85,157 +203,1367 @@ func (d *Dapperfile) argsFromEnv(dockerfile string) ([]string, error) {
 			continue
 		}
 
-		command := fields[0]
-		if command != "ARG" {
-			continue
-		}
+		command := fields[0]
+		if command == "#" && len(fields) == 3 && fields[1] == "ARG" && strings.HasPrefix(fields[2], "GIT_CONFIG:") {
+			if unset != "" {
+				if value := d.gitOutput("config", "--get", strings.TrimPrefix(fields[2], "GIT_CONFIG:")); value != "" {
+					r = append(r, fmt.Sprintf("%s=%s", unset, value))
+				}
+			}
+			unset = ""
+			continue
+		}
+		unset = ""
+
+		if command != "ARG" {
+			continue
+		}
+
+		key := strings.Split(fields[1], "=")[0]
+		value := os.Getenv(key)
+
+		if key == EnvPrefix+"HOST_ARCH" && value == "" {
+			value = d.findHostArch()
+		}
+
+		if key == EnvPrefix+"HOST_ARCH" {
+			d.hostArch = value
+		}
+
+		if value != "" {
+			r = append(r, fmt.Sprintf("%s=%s", key, value))
+		} else {
+			unset = key
+		}
+	}
+
+	return r, d.scanErr(scanner.Err())
+}
+
+// readDirectives collects "# DAPPER_NAME value..." comment lines
+func (d *Dapperfile) readDirectives() (map[string][]string, error) {
+	file, err := d.openFile()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	directives := map[string][]string{}
+	scanner := d.newScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "#" || !strings.HasPrefix(fields[1], "DAPPER_") {
+			continue
+		}
+		directives[fields[1]] = append(directives[fields[1]], fields[2:]...)
+	}
+
+	return directives, d.scanErr(scanner.Err())
+}
+
+func (d *Dapperfile) Run(commandArgs []string) (err error) {
+	var tag, name string
+	defer func() {
+		d.cleanup(err != nil)
+		d.teardown(tag, name, err != nil)
+	}()
+
+	if d.RunExisting {
+		tag, err = d.existingImage()
+	} else {
+		tag, err = d.build(nil, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.BuildOnly {
+		fmt.Println(tag)
+		return nil
+	}
+
+	if err := d.checkEmulation(); err != nil {
+		return err
+	}
+
+	logrus.Debugf("Running build in %s", tag)
+	name, err = d.runContainer(tag, commandArgs)
+	for attempt := 1; err != nil && attempt <= d.RunRetries && d.retryable(err); attempt++ {
+		logrus.Warnf("Build container %s failed: %v, retrying (%d of %d)", name, err, attempt, d.RunRetries)
+		if d.NoCleanupOnFailure {
+			logrus.Infof("Not deleting temp container %s", name)
+		} else {
+			d.runCleanup("temp container " + name)
+		}
+		name, err = d.runContainer(tag, commandArgs)
+		if err == nil {
+			logrus.Infof("Build container %s succeeded on retry %d", name, attempt)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return d.copyOutputs(tag, name)
+}
+
+// OnlyCopy copies back the output from an existing build container, such as
+// one kept with --keep, without building or running. The container must have
+// been created from the image with the computed tag.
+func (d *Dapperfile) OnlyCopy(container string) error {
+	tag, exists, err := d.planRun()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("Image %s does not exist, the output of container %s can not be found", tag, container)
+	}
+
+	image, err := d.execWithOutput("container", "inspect", "-f", "{{.Image}}", container)
+	if err != nil {
+		return fmt.Errorf("Container %s does not exist: %s", container, strings.TrimSpace(string(image)))
+	}
+	id, err := d.execWithOutput("image", "inspect", "-f", "{{.Id}}", tag)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(image)) != strings.TrimSpace(string(id)) {
+		return fmt.Errorf("Container %s was not created from image %s", container, tag)
+	}
+
+	if !d.copyBack() {
+		logrus.Infof("Nothing to copy back from container %s", container)
+		return nil
+	}
+	return d.copyOutputs(tag, container)
+}
+
+// copyOutputs copies back the CopyPlan from the build container.
+func (d *Dapperfile) copyOutputs(tag, name string) error {
+	plan, err := d.CopyPlan()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrOutputCopy, err)
+	}
+	d.artifacts = nil
+	for _, e := range plan {
+		if e.Volume != "" {
+			if err := d.copyFromVolume(tag, e); err != nil {
+				return fmt.Errorf("%w: %v", ErrOutputCopy, err)
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(d.path(e.Destination), 0755); err != nil {
+			return fmt.Errorf("%w: %v", ErrOutputCopy, err)
+		}
+		copyEntry := d.copyOutput
+		if d.DeltaCopy {
+			copyEntry = d.copyDelta
+		}
+		if err := copyEntry(name, e); err != nil {
+			return fmt.Errorf("%w: %v", ErrOutputCopy, err)
+		}
+	}
+
+	if d.ManifestFile != "" {
+		if !d.copyBack() {
+			logrus.Infof("Not writing %s, nothing is copied back", d.ManifestFile)
+		} else if err := d.writeManifestFile(); err != nil {
+			return fmt.Errorf("%w: failed to write %s: %v", ErrOutputCopy, d.ManifestFile, err)
+		}
+	}
+
+	return nil
+}
+
+// runContainer runs the command in a new build container, which is deleted
+// during cleanup unless kept.
+func (d *Dapperfile) runContainer(tag string, commandArgs []string) (string, error) {
+	name, args := d.runArgs(tag, "", commandArgs)
+
+	autoRemove := d.Rm && !d.copyBack()
+	if autoRemove {
+		args = append([]string{"--rm"}, args...)
+	} else if d.Rm {
+		logrus.Infof("Not passing --rm, container %s is needed to copy back output", name)
+	}
+
+	if d.Keep {
+		logrus.Infof("Keeping build container %s", name)
+	} else if autoRemove {
+		logrus.Debugf("Temp container %s is removed by docker", name)
+	} else {
+		d.addCleanup("temp container "+name, func() error {
+			_, err := d.execWithOutput("rm", "-fv", name)
+			return err
+		})
+	}
+
+	if len(d.stopArgs()) > 0 {
+		// stop the container when interrupted while it is running, instead of
+		// passing the signal on, so docker stop uses the signal and timeout
+		// given to docker run and the container can shut down gracefully
+		args = append([]string{"--sig-proxy=false"}, args...)
+		defer d.stopOnInterrupt(name)()
+	}
+
+	if d.Timeout > 0 {
+		// with stop settings the container gets the same graceful shutdown
+		// as when interrupted, otherwise it is killed
+		action, verb := "kill", "killing"
+		if len(d.stopArgs()) > 0 {
+			action, verb = "stop", "stopping"
+		}
+		timer := time.AfterFunc(d.Timeout, func() {
+			logrus.Errorf("Build container %s did not finish within %s, %s it", name, d.Timeout, verb)
+			if output, err := d.execWithOutput(action, name); err != nil {
+				logrus.Debugf("Error running %s on container %s: %v: %s", action, name, err, strings.TrimSpace(string(output)))
+			}
+		})
+		defer timer.Stop()
+	}
+
+	start := time.Now()
+	if err := d.run(args...); err != nil {
+		if d.Timeout > 0 && time.Since(start) >= d.Timeout {
+			return name, fmt.Errorf("%w: %v", ErrTimeout, err)
+		}
+		// docker run exits with 125 when the daemon refuses to create the container
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 125 && len(d.env.Sysctls()) > 0 {
+			logrus.Errorf("Docker could not start the build container, check that the sysctls %v in DAPPER_RUN_SYSCTL "+
+				"are namespaced and allowed by the daemon, some require --privileged in DAPPER_RUN_ARGS", d.env.Sysctls())
+		}
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 125 && d.gpus() != "" {
+			logrus.Errorf("Docker could not start the build container, check that the daemon supports --gpus %s, "+
+				"such as with the NVIDIA container toolkit", d.gpus())
+		}
+		return name, err
+	}
+
+	return name, nil
+}
+
+// stopOnInterrupt runs docker stop on the container if dapper is interrupted
+// until the returned function is called, which waits for the stop to finish.
+func (d *Dapperfile) stopOnInterrupt(name string) func() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		select {
+		case <-interrupt:
+			logrus.Infof("Stopping build container %s", name)
+			if output, err := d.execWithOutput("stop", name); err != nil {
+				logrus.Debugf("Error stopping container %s: %v: %s", name, err, strings.TrimSpace(string(output)))
+			}
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(interrupt)
+		close(done)
+		<-stopped
+	}
+}
+
+// noRetryCodes are the exit codes not retried by default: docker run failed
+// (125), the command could not be run (126) or was not found (127), or the run
+// was interrupted (130).
+var noRetryCodes = map[int]bool{125: true, 126: true, 127: true, 130: true}
+
+// retryable reports whether a failed run should be retried: the command
+// exited with a --retry-on code, or if none are given, with any code except
+// noRetryCodes.
+func (d *Dapperfile) retryable(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.Is(err, ErrTimeout) || !errors.As(err, &exitErr) {
+		return false
+	}
+	if len(d.RetryOn) == 0 {
+		return !noRetryCodes[exitErr.ExitCode()]
+	}
+	for _, code := range d.RetryOn {
+		if code == exitErr.ExitCode() {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFromVolume copies back a volume:<name>:<path> output entry using a
+// container that mounts the volume.
+func (d *Dapperfile) copyFromVolume(tag string, e CopyEntry) error {
+	volume := e.Volume
+	created, err := d.execWithOutput("create", "-v", volume+":"+volumeMount, tag)
+	lines := strings.Fields(string(created))
+	if err != nil || len(lines) == 0 {
+		return fmt.Errorf("Failed to create container for volume %s: %v: %s", volume, err, strings.TrimSpace(string(created)))
+	}
+	// the container ID is the last line, after any warnings
+	container := lines[len(lines)-1]
+	defer func() {
+		if _, err := d.execWithOutput("rm", "-f", container); err != nil {
+			logrus.Debugf("Error deleting volume container %s: %s", container, err)
+		}
+	}()
+
+	if err := os.MkdirAll(d.path(e.Destination), 0755); err != nil {
+		return err
+	}
+	logrus.Infof("Copying back %s from volume %s", e.Output, volume)
+	return d.copyOutput(container, e)
+}
+
+func (d *Dapperfile) Shell(commandArgs []string) error {
+	return d.shell(nil)
+}
+
+// DebugShell starts a shell in the same environment Run would use for
+// commandArgs, with the command Run would execute in DAPPER_DEBUG_COMMAND.
+func (d *Dapperfile) DebugShell(commandArgs []string) error {
+	return d.shell(commandArgs)
+}
+
+func (d *Dapperfile) shell(debugArgs []string) (err error) {
+	defer func() {
+		d.cleanup(err != nil)
+	}()
+
+	tag, err := d.build(nil, true)
+	if err != nil {
+		return err
+	}
+
+	if err := d.checkEmulation(); err != nil {
+		return err
+	}
+
+	logrus.Debugf("Running shell in %s", tag)
+	_, args := d.runArgs(tag, d.env.Shell(), nil)
+	args = append([]string{"--rm"}, args...)
+
+	if debugArgs != nil {
+		command, err := d.debugCommand(tag, debugArgs)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Run \"eval $DAPPER_DEBUG_COMMAND\" to repeat: %s", command)
+		args = append([]string{"-e", "DAPPER_DEBUG_COMMAND=" + command}, args...)
+	}
+
+	// runExec does not return, so clean up now
+	d.cleanup(false)
+
+	return d.runExec(args...)
+}
+
+func (d *Dapperfile) debugCommand(tag string, commandArgs []string) (string, error) {
+	var entrypoint, cmd []string
+
+	output, err := d.execWithOutput("inspect", "-f", "{{json .Config.Entrypoint}}\n{{json .Config.Cmd}}", tag)
+	if err != nil {
+		return "", fmt.Errorf("Failed to inspect %s: %v", tag, err)
+	}
+	lines := strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)
+	if len(lines) != 2 {
+		return "", fmt.Errorf("Failed to inspect %s: %s", tag, output)
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entrypoint); err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &cmd); err != nil {
+		return "", err
+	}
+
+	if len(commandArgs) == 0 {
+		commandArgs = d.env.DefaultCmd()
+	}
+
+	// as with docker run, arguments replace the image CMD
+	if len(commandArgs) > 0 {
+		cmd = commandArgs
+	}
+
+	quoted := []string{}
+	for _, arg := range append(entrypoint, cmd...) {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+func (d *Dapperfile) runArgs(tag, shell string, commandArgs []string) (string, []string) {
+	repo := strings.Split(tag, ":")[0]
+	name := fmt.Sprintf("%s-%s", repo, randString())
+
+	args := []string{"-i", "--name", name}
+
+	args = append(args, "--label", "dapper=true", "--label", "dapper.repo="+repo)
+	for _, label := range d.RunLabels {
+		args = append(args, "--label", label)
+	}
+
+	// docker refuses -t when stdin is not a terminal, and a tty would mangle
+	// piped input anyway, so only allocate one when both ends are terminals
+	if isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd()) {
+		args = append(args, "-t")
+	}
+
+	if d.socket() {
+		args = append(args, "-v", d.vSocket())
+	}
+
+	if d.IsBind() {
+		wd, err := d.workDir()
+		if err == nil {
+			suffix := ""
+			if d.MountSuffix != "" {
+				suffix = ":" + strings.TrimPrefix(d.MountSuffix, ":")
+			}
+			args = append(args, "-v", fmt.Sprintf("%s:%s%s", fmt.Sprintf("%s/%s", wd, d.env.Cp()), d.env.Source(), suffix))
+		}
+	}
+
+	if d.MountGit {
+		args = append(args, d.gitMounts()...)
+	}
+
+	if d.MountTimezone {
+		args = append(args, timezoneArgs()...)
+	}
+
+	if d.MountCA != "" {
+		args = append(args, d.caArgs()...)
+	}
+
+	args = append(args, d.cacheMountArgs()...)
+
+	if d.OutputMount != "" {
+		args = append(args, d.outputMountArgs()...)
+	}
+
+	// os.Getuid and os.Getgid return -1 on Windows
+	if !d.NoIDEnv && os.Getuid() >= 0 && os.Getgid() >= 0 {
+		args = append(args, "-e", fmt.Sprintf("DAPPER_UID=%d", os.Getuid()))
+		args = append(args, "-e", fmt.Sprintf("DAPPER_GID=%d", os.Getgid()))
+	}
+
+	for _, env := range d.envArgs() {
+		args = append(args, "-e", env)
+	}
+
+	for _, name := range d.env.Inject() {
+		if value, ok := d.injectValue(name); ok {
+			args = append(args, "-e", fmt.Sprintf("DAPPER_HOST_%s=%s", strings.ToUpper(name), value))
+		}
+	}
+
+	if gpus := d.gpus(); gpus != "" {
+		args = append(args, "--gpus", gpus)
+	}
+
+	if d.ReadOnly {
+		args = append(args, "--read-only")
+	}
+
+	if size := d.shmSize(); size != "" {
+		args = append(args, "--shm-size", size)
+	}
+
+	if d.RunPlatform != "" {
+		args = append(args, "--platform", d.RunPlatform)
+	}
+
+	args = append(args, d.stopArgs()...)
+
+	for _, sysctl := range d.env.Sysctls() {
+		args = append(args, "--sysctl", sysctl)
+	}
+
+	if driver := d.env.LogDriver(); driver != "" {
+		args = append(args, "--log-driver", driver)
+	}
+	for _, opt := range d.env.LogOpts() {
+		args = append(args, "--log-opt", opt)
+	}
+
+	for _, group := range append(d.env.GroupAdd(), d.GroupAdd...) {
+		args = append(args, "--group-add", group)
+	}
+
+	if d.SocketGroup && d.socket() {
+		if gid, err := d.socketGroup(); err != nil {
+			logrus.Warnf("Not adding the docker socket group: %v", err)
+		} else {
+			args = append(args, "--group-add", gid)
+		}
+	}
+
+	if shell != "" {
+		args = append(args, "--entrypoint", shell)
+		args = append(args, "-e", "TERM")
+	}
+
+	for _, arg := range d.env.RunArgs() {
+		args = append(args, expandEnv(arg))
+	}
+	args = append(args, tag)
+
+	if shell != "" {
+		args = append(args, d.ShellArgs...)
+	}
+
+	if shell != "" && len(commandArgs) == 0 {
+		args = append(args, "-")
+	} else if len(commandArgs) == 0 {
+		args = append(args, d.env.DefaultCmd()...)
+	} else {
+		args = append(args, commandArgs...)
+	}
+
+	return name, args
+}
+
+// socket reports whether to mount the Docker socket. NoSocket overrides
+// DAPPER_DOCKER_SOCKET in the image, which Socket forces on.
+func (d *Dapperfile) socket() bool {
+	if d.NoSocket {
+		return false
+	}
+	return d.env.Socket() || d.Socket
+}
+
+func (d *Dapperfile) gitMounts() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		logrus.Debugf("Not mounting git config: %v", err)
+		return nil
+	}
+
+	args := []string{}
+	for _, name := range []string{".gitconfig", ".git-credentials"} {
+		hostPath := filepath.Join(home, name)
+		if _, err := os.Stat(hostPath); err != nil {
+			logrus.Debugf("Not mounting %s: %v", hostPath, err)
+			continue
+		}
+		args = append(args, "-v", fmt.Sprintf("%s:%s:ro", hostPath, path.Join(d.env.Home(), name)))
+	}
+
+	return args
+}
+
+func (d *Dapperfile) copyBack() bool {
+	return !d.IsBind() && !d.NoOut && len(d.output()) > 0
+}
+
+func (d *Dapperfile) output() []string {
+	output := d.OutputOnly
+	if len(output) == 0 {
+		output = append(d.env.Output(), d.Output...)
+	}
+
+	result := make([]string, 0, len(output))
+	for _, o := range output {
+		result = append(result, d.expandOutput(o))
+	}
+	return result
+}
+
+var outputVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// expandOutput expands $VAR and ${VAR} in an output entry. The variables are
+// DAPPER_HOST_ARCH and DAPPER_HOST_OS, then the build args, then the
+// environment of the image. Unknown variables are left as they are.
+func (d *Dapperfile) expandOutput(output string) string {
+	if !strings.Contains(output, "$") {
+		return output
+	}
+
+	args := d.args()
+	return outputVar.ReplaceAllStringFunc(output, func(ref string) string {
+		name := strings.Trim(ref, "${}")
+		switch name {
+		case "DAPPER_HOST_ARCH", EnvPrefix + "HOST_ARCH":
+			if d.hostArch != "" {
+				return d.hostArch
+			}
+		case "DAPPER_HOST_OS", EnvPrefix + "HOST_OS":
+			if d.hostOS != "" {
+				return d.hostOS
+			}
+		}
+		if v, ok := args[name]; ok {
+			return v
+		}
+		if v, ok := d.env[name]; ok {
+			return v
+		}
+		logrus.Debugf("Not expanding unknown variable %s in output %s", ref, output)
+		return ref
+	})
+}
+
+func (d *Dapperfile) shmSize() string {
+	if d.ShmSize != "" {
+		return d.ShmSize
+	}
+	return d.env.ShmSize()
+}
+
+const volumeMount = "/dapper-volume"
+
+// CopyEntry is an output copied back to the host after the run.
+type CopyEntry struct {
+	// Output is the DAPPER_OUTPUT entry
+	Output string `json:"output"`
+	// Volume is the volume copied from, if not the build container
+	Volume string `json:"volume,omitempty"`
+	// Source is the path in the build container, or in a container that
+	// mounts the volume
+	Source string `json:"source"`
+	// Destination is the directory on the host it is copied into
+	Destination string `json:"destination"`
+}
+
+// CopyPlan returns what is copied back to the host after the run.
+func (d *Dapperfile) CopyPlan() ([]CopyEntry, error) {
+	plan := []CopyEntry{}
+	if !d.copyBack() {
+		return plan, nil
+	}
+
+	source := d.env.Source()
+	for _, i := range d.output() {
+		if strings.HasPrefix(i, "volume:") {
+			parts := strings.SplitN(i, ":", 3)
+			if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+				return nil, fmt.Errorf("Invalid output %q: must be volume:<name>:<path>", i)
+			}
+			p := strings.TrimPrefix(path.Clean("/"+parts[2]), "/")
+			plan = append(plan, CopyEntry{
+				Output:      i,
+				Volume:      parts[1],
+				Source:      path.Join(volumeMount, p),
+				Destination: path.Dir(p),
+			})
+			continue
+		}
+
+		p := i
+		if !strings.HasPrefix(p, "/") {
+			p = path.Join(source, i)
+		}
+		if d.outputMounted(p) {
+			logrus.Debugf("Not copying back %s, it is in the output mount", i)
+			continue
+		}
+		plan = append(plan, CopyEntry{
+			Output:      i,
+			Source:      p,
+			Destination: path.Dir(i),
+		})
+	}
+
+	return plan, nil
+}
+
+// stopArgs returns the docker run flags for how the container is stopped.
+func (d *Dapperfile) stopArgs() []string {
+	var args []string
+	if d.StopSignal != "" {
+		args = append(args, "--stop-signal", d.StopSignal)
+	}
+	if d.StopTimeout > 0 {
+		args = append(args, "--stop-timeout", strconv.Itoa(int((d.StopTimeout+time.Second-1)/time.Second)))
+	}
+	return args
+}
+
+// envArgs returns the DAPPER_ENV entries to pass to the build container.
+// Entries with wildcards are expanded to the matching host variables, and
+// variables matching a !PATTERN entry are then removed, wherever it appears in
+// the list. Each variable is passed once, in the order it was first listed.
+func (d *Dapperfile) envArgs() []string {
+	var include, exclude []string
+	for _, entry := range d.env.Env() {
+		if strings.HasPrefix(entry, "!") {
+			exclude = append(exclude, strings.TrimPrefix(entry, "!"))
+		} else {
+			include = append(include, entry)
+		}
+	}
+
+	var hostNames []string
+	envArgs := []string{}
+	seen := map[string]bool{}
+	add := func(entry string) {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if seen[name] || matchesEnv(name, exclude) {
+			return
+		}
+		seen[name] = true
+		envArgs = append(envArgs, entry)
+	}
+
+	for _, entry := range include {
+		if strings.Contains(entry, "=") || !strings.ContainsAny(entry, "*?[") {
+			add(entry)
+			continue
+		}
+		if hostNames == nil {
+			for _, kv := range os.Environ() {
+				hostNames = append(hostNames, strings.SplitN(kv, "=", 2)[0])
+			}
+			sort.Strings(hostNames)
+		}
+		for _, name := range hostNames {
+			if matchesEnv(name, []string{entry}) {
+				add(name)
+			}
+		}
+	}
+
+	return envArgs
+}
+
+func matchesEnv(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dapperfile) gpus() string {
+	if d.Gpus != "" {
+		return d.Gpus
+	}
+	return d.env.Gpus()
+}
+
+func (d *Dapperfile) injectValue(name string) (string, bool) {
+	switch name {
+	case "hostname":
+		hostname, err := os.Hostname()
+		return hostname, err == nil
+	case "user":
+		u, err := user.Current()
+		if err != nil {
+			return "", false
+		}
+		return u.Username, true
+	case "home":
+		home, err := os.UserHomeDir()
+		return home, err == nil
+	case "arch":
+		return d.hostArch, true
+	case "os":
+		return d.hostOS, true
+	}
+	return "", false
+}
+
+func (d *Dapperfile) checkRunArgs() error {
+	if d.ReadOnly && !d.IsBind() && !hasWritableMount(d.env.RunArgs()) {
+		logrus.Warnf("The build container has a read-only root filesystem and no volumes, add them to DAPPER_RUN_ARGS if the build writes files")
+	}
+
+	for _, name := range d.env.Inject() {
+		if _, ok := d.injectValue(name); !ok {
+			return fmt.Errorf("Invalid DAPPER_INJECT value %s: must be one of hostname, user, home, arch, os", name)
+		}
+	}
+
+	if d.contextTar != "" && d.IsBind() {
+		return errors.New("Bind mode can not be used with a build context read from stdin")
+	}
+
+	if d.Rm && d.Keep {
+		return errors.New("--rm and --keep can not be used together")
+	}
+
+	if err := checkCacheMounts(d.CacheMounts); err != nil {
+		return err
+	}
+
+	if d.OutputMount != "" {
+		if _, _, err := d.outputMount(); err != nil {
+			return err
+		}
+	}
+
+	if len(d.Output) > 0 && len(d.OutputOnly) > 0 {
+		return errors.New("--output and --output-only can not be used together")
+	}
+	for _, o := range append(d.Output, d.OutputOnly...) {
+		if strings.TrimSpace(o) == "" {
+			return errors.New("Output paths must not be empty")
+		}
+	}
+
+	if size := d.shmSize(); size != "" {
+		if err := validateShmSize(size); err != nil {
+			return err
+		}
+	}
+
+	for _, opt := range d.env.LogOpts() {
+		if !strings.Contains(opt, "=") {
+			return fmt.Errorf("Invalid DAPPER_RUN_LOG_OPT value %q: must be key=value", opt)
+		}
+	}
+
+	for _, entry := range d.env.Env() {
+		if _, err := path.Match(strings.TrimPrefix(entry, "!"), ""); err != nil && !strings.Contains(entry, "=") {
+			return fmt.Errorf("Invalid DAPPER_ENV pattern %q: %v", entry, err)
+		}
+	}
+
+	for _, sysctl := range d.env.Sysctls() {
+		kv := strings.SplitN(sysctl, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("Invalid DAPPER_RUN_SYSCTL value %q: must be key=value", sysctl)
+		}
+	}
+
+	if d.StopSignal != "" {
+		if err := validateSignal(d.StopSignal); err != nil {
+			return err
+		}
+	}
+	if d.StopTimeout < 0 {
+		return fmt.Errorf("Invalid stop timeout %s: must not be negative", d.StopTimeout)
+	}
+
+	if gpus := d.gpus(); gpus != "" {
+		if err := validateGpus(gpus); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HostArch returns the architecture dapper uses to pick an image from the
+// # FROM map, without needing a Dockerfile. Like a build, that is the
+// architecture of platform if given, then DAPPER_HOST_ARCH from the
+// environment, then DAPPER_ARCH_CMD or the architecture of the daemon.
+func HostArch(platform string) string {
+	d := &Dapperfile{Platform: platform}
+	if _, arch := d.targetOSArch(); arch != "" {
+		return arch
+	}
+	if arch := os.Getenv(EnvPrefix + "HOST_ARCH"); arch != "" {
+		return arch
+	}
+	if arch, ok := archFromCommand(); ok {
+		return arch
+	}
+	if err := d.lookupDocker(); err != nil {
+		return runtime.GOARCH
+	}
+	return d.daemonArch()
+}
+
+// findHostArch returns the output of DAPPER_ARCH_CMD if set, or else the
+// architecture of the Docker daemon. The command is only run once.
+func (d *Dapperfile) findHostArch() string {
+	if d.archCmd == nil {
+		arch, _ := archFromCommand()
+		d.archCmd = &arch
+	}
+	if *d.archCmd != "" {
+		return *d.archCmd
+	}
+	return d.daemonArch()
+}
+
+// archFromCommand runs DAPPER_ARCH_CMD from the host environment and returns
+// its output, normalized to the Go architecture names docker uses.
+func archFromCommand() (string, bool) {
+	command := os.Getenv("DAPPER_ARCH_CMD")
+	if command == "" {
+		return "", false
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	arch := strings.ToLower(strings.TrimSpace(string(output)))
+	if err != nil || arch == "" {
+		logrus.Warnf("Ignoring DAPPER_ARCH_CMD %q, it failed or printed nothing: %v", command, err)
+		return "", false
+	}
+	arch = dockerArch(arch)
+	logrus.Debugf("Using host arch %s from DAPPER_ARCH_CMD", arch)
+	return arch, true
+}
+
+// daemonArch returns the architecture of the Docker daemon.
+func (d *Dapperfile) daemonArch() string {
+	_, arch := d.daemonPlatform()
+	return arch
+}
+
+// daemonPlatform returns the OS and architecture of the Docker daemon, asking
+// it once and caching the answer for the next invocations.
+func (d *Dapperfile) daemonPlatform() (string, string) {
+	if d.daemon == "" && ArchCache {
+		d.daemon, _ = readArchCache()
+	}
+	if d.daemon == "" {
+		output, err := d.execWithOutput("version", "-f", "{{.Server.Os}}/{{.Server.Arch}}")
+		platform := strings.TrimSpace(string(output))
+		if err != nil || !strings.Contains(platform, "/") {
+			return runtime.GOOS, runtime.GOARCH
+		}
+		d.daemon = platform
+		if ArchCache {
+			writeArchCache(platform)
+		}
+	}
+	parts := strings.SplitN(d.daemon, "/", 2)
+	return parts[0], parts[1]
+}
+
+// prepareArgs sets the build args from the build arg files and the args hook,
+// then expands the templates using them. Each call starts from the args as
+// they were before the first, so a rebuild in --watch does not pass the args
+// through the hook again.
+func (d *Dapperfile) prepareArgs() error {
+	if d.baseArgs == nil {
+		d.baseArgs = append([]string{}, d.Args...)
+	}
+	d.Args = append([]string{}, d.baseArgs...)
+
+	if err := d.readBuildArgFiles(); err != nil {
+		return err
+	}
+	d.applyArgsHook()
+	return d.expandTemplates()
+}
+
+func (d *Dapperfile) readBuildArgFiles() error {
+	for _, v := range d.BuildArgFiles {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("Invalid build arg file %q: must be NAME=path", v)
+		}
+
+		fi, err := os.Stat(d.path(kv[1]))
+		if err != nil {
+			return err
+		}
+		if fi.Size() > maxBuildArgFileSize {
+			return fmt.Errorf("Build arg file %s is larger than %d bytes", kv[1], maxBuildArgFileSize)
+		}
+
+		content, err := ioutil.ReadFile(d.path(kv[1]))
+		if err != nil {
+			return err
+		}
+		d.setArg(kv[0], strings.TrimRight(string(content), "\r\n"))
+	}
+
+	return nil
+}
+
+func (d *Dapperfile) applyArgsHook() {
+	if d.ArgsHook == nil {
+		return
+	}
+
+	args := d.ArgsHook(d.args())
+
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	d.Args = nil
+	for _, k := range keys {
+		d.Args = append(d.Args, fmt.Sprintf("%s=%s", k, args[k]))
+	}
+}
+
+func (d *Dapperfile) setArg(key, value string) {
+	arg := fmt.Sprintf("%s=%s", key, value)
+	for i, v := range d.Args {
+		if strings.SplitN(v, "=", 2)[0] == key {
+			d.Args[i] = arg
+			return
+		}
+	}
+	d.Args = append(d.Args, arg)
+}
+
+func (d *Dapperfile) secretArgs() map[string]bool {
+	secrets := map[string]bool{}
+	for _, v := range d.SecretArgs {
+		for _, key := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }) {
+			secrets[key] = true
+		}
+	}
+	return secrets
+}
+
+func (d *Dapperfile) isBuildKit() bool {
+	if d.buildKit != nil {
+		return *d.buildKit
+	}
+
+	enabled := true
+	if v := os.Getenv("DOCKER_BUILDKIT"); v != "" {
+		enabled, _ = strconv.ParseBool(v)
+	} else if _, err := d.execWithOutput("buildx", "version"); err != nil {
+		// docker build only defaults to BuildKit when buildx is installed
+		enabled = false
+	}
+
+	d.buildKit = &enabled
+	return enabled
+}
+
+func (d *Dapperfile) findHostOS() string {
+	goos, _ := d.daemonPlatform()
+	return goos
+}
+
+func (d *Dapperfile) platform() string {
+	if d.Platform != "" {
+		return d.Platform
+	}
+	// Windows daemons need an explicit platform to build Windows images
+	if d.hostOS == "windows" {
+		return d.hostOS + "/" + d.hostArch
+	}
+	return ""
+}
+
+func (d *Dapperfile) targetOSArch() (string, string) {
+	if d.Platform != "" {
+		parts := strings.Split(d.Platform, "/")
+		if len(parts) > 1 {
+			return parts[0], parts[1]
+		}
+	}
+	return d.hostOS, d.hostArch
+}
+
+// checkArches checks the target architecture against the architectures
+// declared with # DAPPER_ARCHES, failing with --strict-arch.
+func (d *Dapperfile) checkArches() error {
+	arches := d.directives["DAPPER_ARCHES"]
+	if len(arches) == 0 {
+		return nil
+	}
+
+	goos, arch := d.targetOSArch()
+	for _, a := range arches {
+		if a == arch || a == goos+"/"+arch {
+			return nil
+		}
+	}
+
+	if d.StrictArch {
+		return fmt.Errorf("Architecture %s is not one of the supported architectures %v declared by DAPPER_ARCHES", arch, arches)
+	}
+	logrus.Warnf("Architecture %s is not one of the supported architectures %v declared by DAPPER_ARCHES", arch, arches)
+	return nil
+}
+
+func (d *Dapperfile) archImage(images map[string]string) (string, bool) {
+	goos, arch := d.targetOSArch()
+	if image, ok := images[goos+"/"+arch]; ok {
+		return image, true
+	}
+	if image, ok := images[arch]; ok {
+		return image, true
+	}
+	if image, ok := images["default"]; ok {
+		return image, true
+	}
+	image, ok := images["*"]
+	return image, ok
+}
+
+func (d *Dapperfile) Build(args []string) (err error) {
+	defer func() {
+		d.cleanup(err != nil)
+	}()
+
+	_, err = d.build(args, false)
+	return err
+}
+
+func (d *Dapperfile) build(args []string, copy bool) (string, error) {
+	if err := d.checkChanges(); err != nil {
+		return "", err
+	}
+
+	dapperFile, err := d.dapperFile()
+	if err != nil {
+		return "", err
+	}
+
+	if d.Prepull {
+		d.prepull(dapperFile)
+	}
+
+	if d.CacheFrom, err = checkCacheSpecs(d.CacheFrom); err != nil {
+		return "", err
+	}
+
+	if err := d.prepareArgs(); err != nil {
+		return "", err
+	}
+
+	if len(d.secretArgs()) > 0 && !d.isBuildKit() {
+		logrus.Warnf("Build args %v are passed as secrets, which requires BuildKit", d.SecretArgs)
+	}
+	if d.InlineCache && !d.isBuildKit() {
+		logrus.Warnf("--inline-cache requires BuildKit, the image will not have cache metadata")
+	}
+
+	if err := d.checkBuildMounts(); err != nil {
+		return "", err
+	}
+
+	tag := d.tag()
 
-		key := strings.Split(fields[1], "=")[0]
-		value := os.Getenv(key)
+	if d.DebugBundle != "" {
+		if err := d.writeDebugBundle(d.DebugBundle, tag, dapperFile, args); err != nil {
+			return "", err
+		}
+	}
 
-		if key == "DAPPER_HOST_ARCH" && value == "" {
-			value = d.findHostArch()
+	hash := ""
+	if d.Incremental && len(args) == 0 {
+		if hash, err = d.inputHash(dapperFile); err != nil {
+			return "", err
 		}
+	}
 
-		if key == "DAPPER_HOST_ARCH" {
-			d.hostArch = value
+	reused := hash != "" && !d.Force && d.reuseImage(tag, hash)
+	if reused {
+		logrus.Infof("Inputs unchanged, reusing existing image for %s", tag)
+	} else {
+		logrus.Debugf("Building %s using %s", tag, d.File)
+		if err := d.buildImage(tag, dapperFile, args); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrBuildFailed, err)
 		}
+		if d.VerifyTarget != "" {
+			if err := d.verify(dapperFile, args); err != nil {
+				return "", fmt.Errorf("%w: verify target %s failed: %v", ErrBuildFailed, d.VerifyTarget, err)
+			}
+		}
+		if hash != "" {
+			if err := d.saveState(tag, hash); err != nil {
+				logrus.Warnf("Failed to save build state: %v", err)
+			}
+		}
+	}
 
-		if value != "" {
-			r = append(r, fmt.Sprintf("%s=%s", key, value))
+	if d.IIDFile != "" {
+		if err := d.readImageID(tag, reused); err != nil {
+			return "", err
 		}
 	}
 
-	return r, nil
-}
+	if d.TagFile != "" && len(args) == 0 {
+		if err := ioutil.WriteFile(d.path(d.TagFile), []byte(tag+"\n"), 0644); err != nil {
+			return "", fmt.Errorf("Failed to write tag file: %v", err)
+		}
+	}
 
-func (d *Dapperfile) Run(commandArgs []string) error {
-	tag, err := d.build(nil, true)
-	if err != nil {
-		return err
+	if d.CleanupImage && len(args) == 0 {
+		d.addFailureCleanup("image "+tag, func() error {
+			_, err := d.execWithOutput("rmi", tag)
+			return err
+		})
 	}
 
-	logrus.Debugf("Running build in %s", tag)
-	name, args := d.runArgs(tag, "", commandArgs)
-	defer func() {
-		if d.Keep {
-			logrus.Infof("Keeping build container %s", name)
-		} else {
-			logrus.Debugf("Deleting temp container %s", name)
-			if _, err := d.execWithOutput("rm", "-fv", name); err != nil {
-				logrus.Debugf("Error deleting temp container: %s", err)
-			}
+	if copy {
+		if err := d.readEnv(tag); err != nil {
+			return "", err
 		}
-	}()
+	}
 
-	if err := d.run(args...); err != nil {
-		return err
+	if err := d.checkImageBudget(tag); err != nil {
+		return "", err
 	}
 
-	source := d.env.Source()
-	output := d.env.Output()
-	if !d.IsBind() && !d.NoOut {
-		for _, i := range output {
-			p := i
-			if !strings.HasPrefix(p, "/") {
-				p = path.Join(source, i)
+	if !copy {
+		return tag, nil
+	}
+
+	if err := d.checkRunArgs(); err != nil {
+		return "", err
+	}
+
+	if !d.IsBind() {
+		copyFlags := ""
+		if mode := d.env.CpChmod(); mode != "" {
+			if !octalMode.MatchString(mode) {
+				return "", fmt.Errorf("Invalid DAPPER_CP_CHMOD %q: must be an octal mode such as 0755", mode)
 			}
-			targetDir := path.Dir(i)
-			if err := os.MkdirAll(targetDir, 0755); err != nil {
-				return err
+			if !d.isBuildKit() {
+				return "", fmt.Errorf("DAPPER_CP_CHMOD requires BuildKit, set DOCKER_BUILDKIT=1 or install buildx")
 			}
-			logrus.Infof("docker cp %s %s", p, targetDir)
-			if err := d.exec("cp", name+":"+p, targetDir); err != nil {
-				logrus.Debugf("Error copying back '%s': %s", i, err)
+			copyFlags = "--chmod=" + mode + " "
+		}
+		text := fmt.Sprintf("FROM %s\nCOPY %s%s %s", tag, copyFlags, d.env.Cp(), d.env.Source())
+		if err := d.buildWithContent(tag, text, d.env.CpExclude()); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrBuildFailed, err)
+		}
+
+		if base := d.env.CpBase(d.CpBase); base != "" {
+			slim := cpTag(tag)
+			logrus.Infof("Copying the source into %s as %s", base, slim)
+			text := fmt.Sprintf("FROM %s\nCOPY %s%s %s", base, copyFlags, d.env.Cp(), d.env.Source())
+			if err := d.buildWithContent(slim, text, d.env.CpExclude()); err != nil {
+				return "", fmt.Errorf("%w: %v", ErrBuildFailed, err)
 			}
 		}
 	}
 
-	return nil
+	return tag, nil
 }
 
-func (d *Dapperfile) Shell(commandArgs []string) error {
-	tag, err := d.build(nil, true)
-	if err != nil {
-		return err
+// cpTag is the tag of the image with the source copied into DAPPER_CP_BASE,
+// which is kept apart from the image the command runs in.
+func cpTag(tag string) string {
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		return tag + "-cp"
 	}
+	return tag + ":cp"
+}
 
-	logrus.Debugf("Running shell in %s", tag)
-	_, args := d.runArgs(tag, d.env.Shell(), nil)
-	args = append([]string{"--rm"}, args...)
+func (d *Dapperfile) prepull(dapperFile []byte) {
+	var wg sync.WaitGroup
 
-	return d.runExec(args...)
+	for _, image := range baseImages(dapperFile) {
+		wg.Add(1)
+		go func(image string) {
+			defer wg.Done()
+			logrus.Infof("Pulling %s", image)
+			if output, err := d.execWithOutput("pull", "-q", image); err != nil {
+				logrus.Warnf("Failed to pull %s: %v: %s", image, err, strings.TrimSpace(string(output)))
+			}
+		}(image)
+	}
+
+	wg.Wait()
 }
 
-func (d *Dapperfile) runArgs(tag, shell string, commandArgs []string) (string, []string) {
-	name := fmt.Sprintf("%s-%s", strings.Split(tag, ":")[0], randString())
+func (d *Dapperfile) ShowDockerfile() error {
+	dapperFile, err := d.dapperFile()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(dapperFile)
+	return err
+}
 
-	args := []string{"-i", "--name", name}
+func (d *Dapperfile) BuildCommand() []string {
+	return d.buildCommand(d.tag(), d.File, nil)
+}
 
-	if isatty.IsTerminal(os.Stdout.Fd()) {
-		args = append(args, "-t")
-	}
+func (d *Dapperfile) RunCommand(tag string, commandArgs ...string) []string {
+	_, args := d.runArgs(tag, "", commandArgs)
+	return append([]string{"run"}, args...)
+}
 
-	if d.env.Socket() || d.Socket {
-		args = append(args, "-v", d.vSocket())
+// planRun resolves the tag without building and, if the image exists, reads
+// the run settings from it.
+func (d *Dapperfile) planRun() (string, bool, error) {
+	if err := d.prepareArgs(); err != nil {
+		return "", false, err
 	}
 
-	if d.IsBind() {
-		wd, err := os.Getwd()
-		if err == nil {
-			suffix := ""
-			if d.MountSuffix != "" {
-				suffix = ":" + d.MountSuffix
-			}
-			args = append(args, "-v", fmt.Sprintf("%s:%s%s", fmt.Sprintf("%s/%s", wd, d.env.Cp()), d.env.Source(), suffix))
-		}
+	tag := d.tag()
+	if !d.imageExists(tag) {
+		return tag, false, nil
 	}
 
-	args = append(args, "-e", fmt.Sprintf("DAPPER_UID=%d", os.Getuid()))
-	args = append(args, "-e", fmt.Sprintf("DAPPER_GID=%d", os.Getgid()))
-
-	for _, env := range d.env.Env() {
-		args = append(args, "-e", env)
+	if err := d.readEnv(tag); err != nil {
+		return "", false, err
 	}
+	return tag, true, d.checkRunArgs()
+}
 
-	if shell != "" {
-		args = append(args, "--entrypoint", shell)
-		args = append(args, "-e", "TERM")
+// existingImage prepares to run the image with the computed tag without
+// building it first.
+func (d *Dapperfile) existingImage() (string, error) {
+	tag, exists, err := d.planRun()
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", fmt.Errorf("Image %s does not exist, run without --run-existing to build it", tag)
 	}
+	logrus.Debugf("Running existing image %s without building", tag)
+	return tag, nil
+}
 
-	args = append(args, d.env.RunArgs()...)
-	args = append(args, tag)
+// PrintCopyPlan prints CopyPlan as JSON, using the settings of the image if
+// it has already been built.
+func (d *Dapperfile) PrintCopyPlan() error {
+	tag, exists, err := d.planRun()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		logrus.Warnf("Image %s does not exist, only --output and --output-only are included", tag)
+	}
 
-	if shell != "" && len(commandArgs) == 0 {
-		args = append(args, "-")
-	} else {
-		args = append(args, commandArgs...)
+	plan, err := d.CopyPlan()
+	if err != nil {
+		return err
 	}
 
-	return name, args
+	output, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
 }
 
-func (d *Dapperfile) findHostArch() string {
-	output, err := d.execWithOutput("version", "-f", "{{.Server.Arch}}")
+func (d *Dapperfile) PrintCommand(commandArgs []string) error {
+	tag, exists, err := d.planRun()
 	if err != nil {
-		return runtime.GOARCH
+		return err
+	}
+	if !exists {
+		logrus.Debugf("Image %s does not exist, using default settings for run", tag)
 	}
-	return strings.TrimSpace(string(output))
-}
 
-func (d *Dapperfile) Build(args []string) error {
-	_, err := d.build(args, false)
-	return err
-}
+	buildFile := d.File
+	if d.NoContext {
+		buildFile = ""
+	}
 
-func (d *Dapperfile) build(args []string, copy bool) (string, error) {
-	dapperFile, err := d.dapperFile()
-	if err != nil {
-		return "", err
+	// the commands are run from the base directory
+	if d.Dir != "" {
+		fmt.Println("cd " + shellQuote(d.Dir))
 	}
+	fmt.Println(strings.Join(append([]string{"docker"}, d.buildCommand(tag, buildFile, nil)...), " "))
+	fmt.Println(strings.Join(append([]string{"docker"}, d.RunCommand(tag, commandArgs...)...), " "))
+	return nil
+}
 
-	tag := d.tag()
-	logrus.Debugf("Building %s using %s", tag, d.File)
+func (d *Dapperfile) buildCommand(tag, dockerfile string, args []string) []string {
 	buildArgs := []string{"build"}
 	if len(args) == 0 {
 		buildArgs = append(buildArgs, "-t", tag)
@@ -249,67 +1577,197 @@ func (d *Dapperfile) build(args []string, copy bool) (string, error) {
 		buildArgs = append(buildArgs, "--target", d.Target)
 	}
 
+	if platform := d.platform(); platform != "" {
+		buildArgs = append(buildArgs, "--platform", platform)
+	}
+
+	if d.IIDFile != "" {
+		buildArgs = append(buildArgs, "--iidfile", d.IIDFile)
+	}
+
+	if d.CompressContext && dockerfile != "" {
+		buildArgs = append(buildArgs, "--compress")
+	}
+
+	labels := append(append([]string{}, d.labels()...), d.autoLabels()...)
+	for _, label := range labels {
+		buildArgs = append(buildArgs, "--label", label)
+	}
+
+	secrets := d.secretArgs()
 	for _, v := range d.Args {
-		buildArgs = append(buildArgs, "--build-arg", v)
+		key := strings.SplitN(v, "=", 2)[0]
+		if secrets[key] {
+			buildArgs = append(buildArgs, "--secret", fmt.Sprintf("id=%s,env=%s", key, key))
+		} else {
+			buildArgs = append(buildArgs, "--build-arg", v)
+		}
 	}
 
-	if d.NoContext {
+	for _, v := range d.CacheFrom {
+		buildArgs = append(buildArgs, "--cache-from", v)
+	}
+
+	if d.InlineCache {
+		buildArgs = append(buildArgs, "--build-arg", "BUILDKIT_INLINE_CACHE=1")
+	}
+
+	for _, v := range d.BuildMounts {
+		buildArgs = append(buildArgs, "--build-context", v)
+	}
+
+	if d.MountCA != "" && d.isBuildKit() {
+		buildArgs = append(buildArgs, "--build-context", caContext+"="+d.caContextDir())
+	}
+
+	if dockerfile == "" {
 		buildArgs = append(buildArgs, "-")
+		return append(buildArgs, args...)
+	}
+
+	buildArgs = append(buildArgs, "-f", dockerfile)
+	if d.contextTar != "" {
 		buildArgs = append(buildArgs, args...)
-		if err := d.execWithStdin(bytes.NewBuffer(dapperFile), buildArgs...); err != nil {
-			return "", err
-		}
-	} else {
-		tempfile, err := d.tempfile(dapperFile)
+		return append(buildArgs, "-")
+	}
+	if len(args) > 0 {
+		return append(buildArgs, args...)
+	}
+	return append(buildArgs, ".")
+}
+
+func (d *Dapperfile) readImageID(tag string, reused bool) error {
+	// docker build did not run, so write the ID of the reused image
+	if reused {
+		output, err := d.execWithOutput("image", "inspect", "-f", "{{.Id}}", tag)
 		if err != nil {
-			return "", err
+			return err
 		}
-		defer os.Remove(tempfile)
-
-		buildArgs = append(buildArgs, "-f", tempfile)
-		if len(args) > 0 {
-			buildArgs = append(buildArgs, args...)
-		} else {
-			buildArgs = append(buildArgs, ".")
+		if err := ioutil.WriteFile(d.path(d.IIDFile), bytes.TrimSpace(output), 0644); err != nil {
+			return err
 		}
+	}
 
-		if err := d.exec(buildArgs...); err != nil {
-			return "", err
-		}
+	id, err := ioutil.ReadFile(d.path(d.IIDFile))
+	if err != nil {
+		return fmt.Errorf("Failed to read image ID: %v", err)
 	}
+	d.ImageID = strings.TrimSpace(string(id))
+	logrus.Debugf("Image ID: %s", d.ImageID)
+	return nil
+}
 
-	if !copy {
-		return tag, nil
+func (d *Dapperfile) imageExists(tag string) bool {
+	_, err := d.execWithOutput("image", "inspect", "-f", "{{.Id}}", tag)
+	return err == nil
+}
+
+func (d *Dapperfile) buildImage(tag string, dapperFile []byte, args []string) error {
+	if d.NoContext {
+		return d.execWithStdin(bytes.NewBuffer(dapperFile), d.buildCommand(tag, "", args)...)
 	}
 
-	if err := d.readEnv(tag); err != nil {
-		return "", err
+	if d.CompressContext {
+		d.checkCompress()
 	}
 
-	if !d.IsBind() {
-		text := fmt.Sprintf("FROM %s\nCOPY %s %s", tag, d.env.Cp(), d.env.Source())
-		if err := d.buildWithContent(tag, text); err != nil {
-			return "", err
-		}
+	if d.contextTar != "" {
+		name := d.contextDockerfile()
+		return d.buildFromContext(name, dapperFile, d.buildCommand(tag, name, args)...)
 	}
 
-	return tag, nil
+	tempfile, err := d.tempfile(dapperFile)
+	if err != nil {
+		return err
+	}
+	d.addCleanup("tempfile "+tempfile, func() error {
+		return os.Remove(tempfile)
+	})
+	// the tempfile is in the source, so don't leave it there while the
+	// build container runs
+	defer d.runCleanup("tempfile " + tempfile)
+
+	return d.exec(d.buildCommand(tag, tempfile, args)...)
+}
+
+// verify builds the --verify-target stage, so checks such as a lint stage can
+// fail the build. The stage is built with a temporary tag that is deleted
+// right after, since only the result of the build matters.
+func (d *Dapperfile) verify(dapperFile []byte, args []string) error {
+	target, iidFile := d.Target, d.IIDFile
+	d.Target, d.IIDFile = d.VerifyTarget, ""
+	defer func() {
+		d.Target, d.IIDFile = target, iidFile
+	}()
+
+	tag := "dapper-verify:" + strings.ToLower(randString())
+	logrus.Infof("Building verify target %s", d.VerifyTarget)
+	err := d.buildImage(tag, dapperFile, args)
+	if output, rmErr := d.execWithOutput("rmi", tag); rmErr != nil {
+		logrus.Debugf("Error deleting %s: %v: %s", tag, rmErr, strings.TrimSpace(string(output)))
+	}
+	return err
 }
 
-func (d *Dapperfile) buildWithContent(tag, content string) error {
+func (d *Dapperfile) buildWithContent(tag, content string, excludes []string) error {
+	buildArgs := []string{"build", "-t", tag}
+	if platform := d.platform(); platform != "" {
+		buildArgs = append(buildArgs, "--platform", platform)
+	}
+
+	if d.contextTar != "" {
+		if len(excludes) > 0 {
+			logrus.Warnf("Ignoring DAPPER_CP_EXCLUDE, it is not supported with a build context read from stdin")
+		}
+		name := d.contextDockerfile()
+		return d.buildFromContext(name, []byte(content), append(buildArgs, "-f", name, "-")...)
+	}
+
 	tempfile, err := d.tempfile([]byte(content))
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		logrus.Debugf("Deleting tempfile %s", tempfile)
-		if err := os.Remove(tempfile); err != nil {
-			logrus.Errorf("Failed to delete tempfile %s: %v", tempfile, err)
+	d.addCleanup("tempfile "+tempfile, func() error {
+		return os.Remove(tempfile)
+	})
+	defer d.runCleanup("tempfile " + tempfile)
+	defer d.runCleanup("ignore file " + tempfile + ".dockerignore")
+
+	if len(excludes) > 0 {
+		if err := d.writeIgnoreFile(tempfile, excludes); err != nil {
+			return err
 		}
-	}()
+	}
+
+	return d.exec(append(buildArgs, "-f", tempfile, ".")...)
+}
+
+// writeIgnoreFile writes <dockerfile>.dockerignore, which BuildKit uses
+// instead of the .dockerignore in the context, so it must include both.
+func (d *Dapperfile) writeIgnoreFile(dockerfile string, excludes []string) error {
+	if !d.isBuildKit() {
+		logrus.Warnf("DAPPER_CP_EXCLUDE requires BuildKit, %v will be copied", excludes)
+	}
+
+	content, err := ioutil.ReadFile(d.path(".dockerignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	content = append(content, '\n')
+	content = append(content, strings.Join(excludes, "\n")...)
+	content = append(content, '\n')
+
+	ignoreFile := dockerfile + ".dockerignore"
+	if err := ioutil.WriteFile(ignoreFile, content, 0644); err != nil {
+		return err
+	}
+	d.addCleanup("ignore file "+ignoreFile, func() error {
+		return os.Remove(ignoreFile)
+	})
 
-	return d.exec("build", "-t", tag, "-f", tempfile, ".")
+	logrus.Debugf("Excluding %v from copy using %s", excludes, ignoreFile)
+	return nil
 }
 
 func (d *Dapperfile) readEnv(tag string) error {
@@ -317,7 +1775,8 @@ func (d *Dapperfile) readEnv(tag string) error {
 
 	args := []string{"inspect", "-f", "{{json .Config.Env}}", tag}
 
-	cmd := exec.Command(d.docker, args...)
+	cmd := d.command(d.docker, args...)
+	cmd.Env = d.environ()
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		logrus.Errorf("Failed to run docker %v: %v", args, err)
@@ -334,21 +1793,36 @@ func (d *Dapperfile) readEnv(tag string) error {
 		parts := strings.SplitN(item, "=", 2)
 		k, v := parts[0], parts[1]
 		logrus.Debugf("Reading Env: %s=%s", k, v)
+		if EnvPrefix != "DAPPER_" {
+			if strings.HasPrefix(k, "DAPPER_") {
+				continue
+			}
+			if strings.HasPrefix(k, EnvPrefix) {
+				k = "DAPPER_" + strings.TrimPrefix(k, EnvPrefix)
+			}
+		}
 		d.env[k] = v
 	}
 
 	logrus.Debugf("Source: %s", d.env.Source())
 	logrus.Debugf("Cp: %s", d.env.Cp())
-	logrus.Debugf("Socket: %t", d.env.Socket())
+	logrus.Debugf("Socket: %t", d.socket())
 	logrus.Debugf("Mode: %s", d.env.Mode(d.Mode))
-	logrus.Debugf("Env: %v", d.env.Env())
-	logrus.Debugf("Output: %v", d.env.Output())
+	logrus.Debugf("Env: %v", d.envArgs())
+	logrus.Debugf("Output: %v", d.output())
 
 	return nil
 }
 
 func (d *Dapperfile) tag() string {
-	cwd, err := os.Getwd()
+	if d.expandedTag != "" {
+		return d.expandedTag
+	}
+	if d.Tag != "" && !strings.Contains(d.Tag, "{{") {
+		return d.Tag
+	}
+
+	cwd, err := d.workDir()
 	if err == nil {
 		cwd = filepath.Base(cwd)
 	} else {
@@ -357,23 +1831,71 @@ func (d *Dapperfile) tag() string {
 	// repository name must be lowercase
 	cwd = strings.ToLower(cwd)
 
-	output, _ := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output()
-	tag := strings.TrimSpace(string(output))
+	tag := d.gitOutput("rev-parse", "--abbrev-ref", "HEAD")
 	if tag == "" {
 		tag = randString()
 	}
-	tag = re.ReplaceAllLiteralString(tag, "-")
+	tag = sanitizeTag(tag)
 
 	return fmt.Sprintf("%s:%s", cwd, tag)
 }
 
+// environ is the environment docker is run with. With CleanEnv only PATH,
+// HOME, DOCKER_* and the variables that are passed on to the build are kept.
+func (d *Dapperfile) environ() []string {
+	if !d.CleanEnv {
+		return os.Environ()
+	}
+
+	keep := map[string]bool{"PATH": true, "HOME": true}
+	for _, name := range append(d.envArgs(), d.CleanEnvAllow...) {
+		keep[strings.SplitN(name, "=", 2)[0]] = true
+	}
+
+	env := []string{}
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if keep[name] || strings.HasPrefix(name, "DOCKER_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// commandEnv returns the environment for running docker with args. Only
+// docker build gets the secret build args.
+func (d *Dapperfile) commandEnv(args []string) []string {
+	if len(args) > 0 && args[0] == "build" {
+		return d.withSecrets(d.environ())
+	}
+	return d.environ()
+}
+
+// withSecrets adds the values of the build args passed as secrets to env, for
+// --secret env=NAME, since they may come from a build arg file, git config or
+// the args hook rather than the host environment. exec uses the last value of
+// a variable, so these take precedence.
+func (d *Dapperfile) withSecrets(env []string) []string {
+	secrets := d.secretArgs()
+	if len(secrets) == 0 {
+		return env
+	}
+	for _, v := range d.Args {
+		if kv := strings.SplitN(v, "=", 2); len(kv) == 2 && secrets[kv[0]] {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
 func (d *Dapperfile) run(args ...string) error {
 	return d.exec(append([]string{"run"}, args...)...)
 }
 
 func (d *Dapperfile) exec(args ...string) error {
 	logrus.Debugf("Running %s %v", d.docker, args)
-	cmd := exec.Command(d.docker, args...)
+	cmd := d.command(d.docker, args...)
+	cmd.Env = d.commandEnv(args)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
@@ -386,7 +1908,8 @@ func (d *Dapperfile) exec(args ...string) error {
 
 func (d *Dapperfile) execWithStdin(stdin io.Reader, args ...string) error {
 	logrus.Debugf("Running %s %v", d.docker, args)
-	cmd := exec.Command(d.docker, args...)
+	cmd := d.command(d.docker, args...)
+	cmd.Env = d.commandEnv(args)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = stdin
@@ -399,11 +1922,18 @@ func (d *Dapperfile) execWithStdin(stdin io.Reader, args ...string) error {
 
 func (d *Dapperfile) runExec(args ...string) error {
 	logrus.Debugf("Exec %s run %v", d.docker, args)
-	return syscall.Exec(d.docker, append([]string{"docker", "run"}, args...), os.Environ())
+	// the process is replaced, so changing its directory is safe here
+	if d.Dir != "" {
+		if err := os.Chdir(d.Dir); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(d.docker, append([]string{"docker", "run"}, args...), d.environ())
 }
 
 func (d *Dapperfile) execWithOutput(args ...string) ([]byte, error) {
-	cmd := exec.Command(d.docker, args...)
+	cmd := d.command(d.docker, args...)
+	cmd.Env = d.commandEnv(args)
 	return cmd.CombinedOutput()
 }
 
@@ -411,13 +1941,20 @@ func (d *Dapperfile) IsBind() bool {
 	return d.env.Mode(d.Mode) == "bind"
 }
 
+func (d *Dapperfile) openFile() (io.ReadCloser, error) {
+	if d.contextFile != nil {
+		return ioutil.NopCloser(bytes.NewReader(d.contextFile)), nil
+	}
+	return os.Open(d.path(d.File))
+}
+
 func (d *Dapperfile) dapperFile() ([]byte, error) {
 	var input io.Reader
 
 	if d.NoContext {
 		input = os.Stdin
 	} else {
-		f, err := os.Open(d.File)
+		f, err := d.openFile()
 		if err != nil {
 			return nil, err
 		}
@@ -426,17 +1963,21 @@ func (d *Dapperfile) dapperFile() ([]byte, error) {
 	}
 
 	buffer := &bytes.Buffer{}
-	scanner := bufio.NewScanner(input)
+	scanner := d.newScanner(input)
 
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "FROM ") && len(strings.Fields(line)) == 2 && scanner.Scan() {
 			nextLine := scanner.Text()
 			if strings.HasPrefix(nextLine, "# FROM") {
-				baseImage, ok := toMap(nextLine)[d.hostArch]
+				baseImage, ok := d.archImage(toMap(nextLine))
 				if ok && baseImage == "skip" {
 					return nil, ErrSkipBuild
 				}
+				if !ok && d.StrictArch {
+					goos, arch := d.targetOSArch()
+					return nil, fmt.Errorf("The %q map has no entry for %s or %s/%s", nextLine, arch, goos, arch)
+				}
 				if ok {
 					line = "FROM " + baseImage
 				}
@@ -448,5 +1989,41 @@ func (d *Dapperfile) dapperFile() ([]byte, error) {
 		buffer.WriteString("\n")
 	}
 
-	return buffer.Bytes(), scanner.Err()
+	if err := d.scanErr(scanner.Err()); err != nil {
+		return nil, err
+	}
+
+	if err := d.checkArches(); err != nil {
+		return nil, err
+	}
+
+	if d.Frontend != "" && !imageRef.MatchString(d.Frontend) {
+		return nil, fmt.Errorf("Invalid frontend %q: must be an image reference such as docker/dockerfile:1.7", d.Frontend)
+	}
+
+	return d.addSyntax(buffer.Bytes()), nil
+}
+
+// addSyntax prepends a syntax parser directive if there is none. Parser
+// directives are only recognized before any other line, so an existing one
+// is always at the top.
+func (d *Dapperfile) addSyntax(dockerfile []byte) []byte {
+	if d.Frontend != "" {
+		if syntax, ok := parserDirectives(dockerfile)["syntax"]; ok && syntax != d.Frontend {
+			logrus.Infof("Replacing syntax directive %s with frontend %s", syntax, d.Frontend)
+		}
+		dockerfile = withoutParserDirective(dockerfile, "syntax")
+		return append([]byte(fmt.Sprintf("# syntax=%s\n", d.Frontend)), dockerfile...)
+	}
+
+	if d.DockerfileSyntax == "" {
+		return dockerfile
+	}
+
+	if syntax, ok := parserDirectives(dockerfile)["syntax"]; ok {
+		logrus.Debugf("Keeping existing syntax directive %s", syntax)
+		return dockerfile
+	}
+
+	return append([]byte(fmt.Sprintf("# syntax=%s\n", d.DockerfileSyntax)), dockerfile...)
 }
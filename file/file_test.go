@@ -0,0 +1,247 @@
+package file
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDapperFileLongLines(t *testing.T) {
+	long := "RUN echo " + strings.Repeat("x", 100*1024)
+	tests := []struct {
+		name        string
+		maxLineSize int
+		wantErr     bool
+	}{
+		{"over the default scanner limit", 4 * 1024 * 1024, false},
+		{"over the configured limit", 64 * 1024, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(size int) { MaxLineSize = size }(MaxLineSize)
+			MaxLineSize = tt.maxLineSize
+
+			d := &Dapperfile{
+				File:        "Dockerfile.dapper",
+				contextFile: []byte("FROM alpine\n" + long + "\nARG DAPPER_TEST_ARG\n"),
+			}
+			os.Setenv("DAPPER_TEST_ARG", "value")
+			defer os.Unsetenv("DAPPER_TEST_ARG")
+
+			content, err := d.dapperFile()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "--max-line-size") {
+					t.Fatalf("dapperFile() error = %v, want a line too long error", err)
+				}
+				if _, err := d.argsFromEnv(); err == nil {
+					t.Fatalf("argsFromEnv() error = nil, want a line too long error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dapperFile() error = %v", err)
+			}
+			if !strings.Contains(string(content), "\n"+long+"\n") {
+				t.Errorf("dapperFile() did not keep the %d byte line", len(long))
+			}
+			args, err := d.argsFromEnv()
+			if err != nil {
+				t.Fatalf("argsFromEnv() error = %v", err)
+			}
+			if len(args) != 1 || args[0] != "DAPPER_TEST_ARG=value" {
+				t.Errorf("argsFromEnv() = %v, want the ARG after the long line", args)
+			}
+		})
+	}
+}
+
+func TestDapperFileFromMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		fromMap string
+		arch    string
+		want    string
+		wantErr error
+	}{
+		{"exact match", "# FROM amd64=golang:amd64 arm64=golang:arm64", "arm64", "FROM golang:arm64", nil},
+		{"no default keeps the FROM line", "# FROM amd64=golang:amd64", "arm64", "FROM golang", nil},
+		{"default", "# FROM amd64=golang:amd64 default=golang:other", "s390x", "FROM golang:other", nil},
+		{"exact match before default", "# FROM arm64=golang:arm64 default=golang:other", "arm64", "FROM golang:arm64", nil},
+		{"star", "# FROM amd64=golang:amd64 *=golang:other", "riscv64", "FROM golang:other", nil},
+		{"skip with default", "# FROM arm=skip default=golang:other", "arm", "", ErrSkipBuild},
+		{"default skip", "# FROM amd64=golang:amd64 default=skip", "arm64", "", ErrSkipBuild},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dapperfile{
+				File:        "Dockerfile.dapper",
+				hostOS:      "linux",
+				hostArch:    tt.arch,
+				contextFile: []byte("FROM golang\n" + tt.fromMap + "\nRUN make\n"),
+			}
+			content, err := d.dapperFile()
+			if err != tt.wantErr {
+				t.Fatalf("dapperFile() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := strings.SplitN(string(content), "\n", 2)[0]; got != tt.want {
+				t.Errorf("dapperFile() FROM line = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDapperFileSyntax(t *testing.T) {
+	body := "FROM golang\n" +
+		"# FROM amd64=golang:amd64\n" +
+		"RUN --mount=type=cache,target=/root/.cache/go-build go build ./...\n" +
+		"RUN <<EOF\n" +
+		"FROM is not an instruction here\n" +
+		"echo done\n" +
+		"EOF\n"
+	assembled := strings.Replace(body, "FROM golang\n", "FROM golang:amd64\n", 1)
+
+	tests := []struct {
+		name       string
+		dockerfile string
+		syntax     string
+		frontend   string
+		want       string
+	}{
+		{"no directive", body, "", "", assembled},
+		{"directive kept first", "# syntax=docker/dockerfile:1.6\n" + body, "", "", "# syntax=docker/dockerfile:1.6\n" + assembled},
+		{"directive injected", body, "docker/dockerfile:1.7", "", "# syntax=docker/dockerfile:1.7\n" + assembled},
+		{"existing directive wins", "# syntax=docker/dockerfile:1.6\n" + body, "docker/dockerfile:1.7", "",
+			"# syntax=docker/dockerfile:1.6\n" + assembled},
+		{"frontend replaces directive", "# syntax=docker/dockerfile:1.6\n" + body, "", "registry.example.com:5000/dockerfile:1.7",
+			"# syntax=registry.example.com:5000/dockerfile:1.7\n" + assembled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dapperfile{
+				File:             "Dockerfile.dapper",
+				hostOS:           "linux",
+				hostArch:         "amd64",
+				DockerfileSyntax: tt.syntax,
+				Frontend:         tt.frontend,
+				contextFile:      []byte(tt.dockerfile),
+			}
+			content, err := d.dapperFile()
+			if err != nil {
+				t.Fatalf("dapperFile() error = %v", err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("dapperFile() = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
+
+// containsArgs reports whether want appears in args as consecutive elements.
+func containsArgs(args []string, want ...string) bool {
+	for i := 0; i+len(want) <= len(args); i++ {
+		if strings.Join(args[i:i+len(want)], "\x00") == strings.Join(want, "\x00") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuildCommandInlineCache(t *testing.T) {
+	inlineCache := []string{"--build-arg", "BUILDKIT_INLINE_CACHE=1"}
+	tests := []struct {
+		name        string
+		inlineCache bool
+		cacheFrom   []string
+		want        bool
+	}{
+		{"off", false, nil, false},
+		{"on", true, nil, true},
+		{"on with the image as cache", true, []string{"example.com/app:main"}, true},
+		{"cache from only", false, []string{"example.com/app:main"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dapperfile{InlineCache: tt.inlineCache, CacheFrom: tt.cacheFrom}
+			args := d.buildCommand("example.com/app:main", "Dockerfile.dapper", nil)
+			if got := containsArgs(args, inlineCache...); got != tt.want {
+				t.Errorf("buildCommand() = %v, has %v = %v, want %v", args, inlineCache, got, tt.want)
+			}
+			for _, spec := range tt.cacheFrom {
+				if !containsArgs(args, "--cache-from", spec) {
+					t.Errorf("buildCommand() = %v, want --cache-from %s", args, spec)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		d          *Dapperfile
+		dockerfile string
+		args       []string
+		want       []string
+	}{
+		{"defaults", &Dapperfile{}, "Dockerfile.dapper", nil,
+			[]string{"build", "-t", "app:test", "-f", "Dockerfile.dapper", "."}},
+		{"no context", &Dapperfile{}, "", nil,
+			[]string{"build", "-t", "app:test", "-"}},
+		{"extra args replace the tag and context", &Dapperfile{}, "Dockerfile.dapper", []string{"--no-cache", "."},
+			[]string{"build", "-f", "Dockerfile.dapper", "--no-cache", "."}},
+		{"target and platform", &Dapperfile{Quiet: true, Target: "dev", Platform: "linux/arm64"}, "Dockerfile.dapper", nil,
+			[]string{"build", "-t", "app:test", "-q", "--target", "dev", "--platform", "linux/arm64", "-f", "Dockerfile.dapper", "."}},
+		{"build args and secrets", &Dapperfile{Args: []string{"VERSION=1", "TOKEN=secret"}, SecretArgs: []string{"TOKEN"}},
+			"Dockerfile.dapper", nil,
+			[]string{"build", "-t", "app:test", "--build-arg", "VERSION=1", "--secret", "id=TOKEN,env=TOKEN",
+				"-f", "Dockerfile.dapper", "."}},
+		{"labels", &Dapperfile{Labels: []string{"team=build"}}, "Dockerfile.dapper", nil,
+			[]string{"build", "-t", "app:test", "--label", "team=build", "-f", "Dockerfile.dapper", "."}},
+		{"context from stdin", &Dapperfile{contextTar: "context.tar"}, ".dapper-Dockerfile", nil,
+			[]string{"build", "-t", "app:test", "-f", ".dapper-Dockerfile", "-"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.d.buildCommand("app:test", tt.dockerfile, tt.args)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("buildCommand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         Context
+		commandArgs []string
+		wantTail    []string
+	}{
+		{"command", Context{}, []string{"make", "test"}, []string{"app:test", "make", "test"}},
+		{"default command", Context{"DAPPER_RUN_CMD": "make ci"}, nil, []string{"app:test", "make", "ci"}},
+		{"run args before the tag", Context{"DAPPER_RUN_ARGS": "--privileged  --net host"}, []string{"make"},
+			[]string{"--privileged", "--net", "host", "app:test", "make"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dapperfile{env: tt.env, Mode: "cp"}
+			got := d.RunCommand("app:test", tt.commandArgs...)
+			if len(got) < 4 || got[0] != "run" || got[1] != "-i" || got[2] != "--name" || !strings.HasPrefix(got[3], "app-") {
+				t.Fatalf("RunCommand() = %v, want run -i --name app-<random>", got)
+			}
+			tail := got[len(got)-len(tt.wantTail):]
+			if strings.Join(tail, " ") != strings.Join(tt.wantTail, " ") {
+				t.Errorf("RunCommand() = %v, want it to end with %v", got, tt.wantTail)
+			}
+		})
+	}
+}
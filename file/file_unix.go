@@ -4,8 +4,22 @@ package file
 
 import (
 	"fmt"
+	"os"
+	"syscall"
 )
 
 func (d *Dapperfile) vSocket() string {
-	return fmt.Sprintf("%s:/var/run/docker.sock", d.env.HostSocket())
+	return fmt.Sprintf("%s:%s", d.env.HostSocket(), d.env.SocketPath())
+}
+
+func (d *Dapperfile) socketGroup() (string, error) {
+	fi, err := os.Stat(d.env.HostSocket())
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("Failed to read the group of %s", d.env.HostSocket())
+	}
+	return fmt.Sprint(st.Gid), nil
 }
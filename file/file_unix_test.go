@@ -0,0 +1,78 @@
+// +build linux freebsd openbsd darwin
+
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeDocker writes a docker that saves its stdin to a file, and returns the
+// path of the script and of the file.
+func fakeDocker(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "dapper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := filepath.Join(dir, "stdin")
+	docker := filepath.Join(dir, "docker")
+	if err := ioutil.WriteFile(docker, []byte("#!/bin/sh\ncat > "+stdin+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return docker, stdin
+}
+
+func TestRunPipedStdin(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"line", "manifest\n"},
+		{"no trailing newline", "a\nb"},
+		{"larger than a pipe buffer", string(make([]byte, 256*1024))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker, stdin := fakeDocker(t)
+			defer os.RemoveAll(filepath.Dir(docker))
+
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func(f *os.File) { os.Stdin = f }(os.Stdin)
+			os.Stdin = r
+			go func() {
+				w.WriteString(tt.input)
+				w.Close()
+			}()
+
+			d := &Dapperfile{File: "Dockerfile.dapper", docker: docker}
+			_, args := d.runArgs("app:test", "", []string{"build-tool"})
+			for _, arg := range args {
+				if arg == "-t" {
+					t.Errorf("runArgs() = %v, want no -t with piped stdin", args)
+				}
+			}
+			if args[0] != "-i" {
+				t.Errorf("runArgs() = %v, want -i", args)
+			}
+
+			if err := d.run(args...); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			r.Close()
+			got, err := ioutil.ReadFile(stdin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.input {
+				t.Errorf("docker run got %d bytes of stdin, want %d", len(got), len(tt.input))
+			}
+		})
+	}
+}
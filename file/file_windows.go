@@ -1,9 +1,14 @@
 package file
 
 import (
+	"errors"
 	"fmt"
 )
 
 func (d *Dapperfile) vSocket() string {
-	return fmt.Sprintf("%s://./pipe/docker_engine", d.env.HostSocket())
+	return fmt.Sprintf("%s:%s", d.env.HostSocket(), d.env.SocketPath())
+}
+
+func (d *Dapperfile) socketGroup() (string, error) {
+	return "", errors.New("Socket groups are not supported on Windows")
 }
@@ -0,0 +1,72 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Arches returns the architectures declared with # DAPPER_ARCHES in file,
+// relative to dir. There are none if the file does not exist.
+func Arches(dir, file string) ([]string, error) {
+	d := &Dapperfile{File: file, Dir: dir}
+	if _, err := os.Stat(d.path(file)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	directives, err := d.readDirectives()
+	if err != nil {
+		return nil, err
+	}
+	return directives["DAPPER_ARCHES"], nil
+}
+
+// Manifest assembles the images tagged <tag>-<arch> by earlier per-arch
+// builds into a manifest list named tag and pushes it. Arches are either an
+// architecture such as arm64 or an OS and architecture such as windows/amd64.
+func Manifest(tag string, arches []string) error {
+	if len(arches) == 0 {
+		return errors.New("no architectures: pass --manifest-arch or declare # DAPPER_ARCHES")
+	}
+
+	d := &Dapperfile{}
+	if err := d.lookupDocker(); err != nil {
+		return err
+	}
+
+	images := []string{}
+	for _, arch := range arches {
+		images = append(images, manifestImage(tag, arch))
+	}
+
+	logrus.Infof("Creating manifest %s from %v", tag, images)
+	if err := d.exec(append([]string{"manifest", "create", "--amend", tag}, images...)...); err != nil {
+		return err
+	}
+
+	for _, arch := range arches {
+		goos, goarch, variant := "linux", arch, ""
+		if parts := strings.Split(arch, "/"); len(parts) > 1 {
+			goos, goarch = parts[0], parts[1]
+			if len(parts) > 2 {
+				variant = parts[2]
+			}
+		}
+
+		args := []string{"manifest", "annotate", tag, manifestImage(tag, arch), "--os", goos, "--arch", goarch}
+		if variant != "" {
+			args = append(args, "--variant", variant)
+		}
+		if err := d.exec(args...); err != nil {
+			return err
+		}
+	}
+
+	return d.exec("manifest", "push", tag)
+}
+
+func manifestImage(tag, arch string) string {
+	return fmt.Sprintf("%s-%s", tag, strings.Replace(arch, "/", "-", -1))
+}
@@ -0,0 +1,44 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManifestImage(t *testing.T) {
+	tests := []struct {
+		arch string
+		want string
+	}{
+		{"amd64", "app:main-amd64"},
+		{"arm64", "app:main-arm64"},
+		{"windows/amd64", "app:main-windows-amd64"},
+		{"linux/arm/v7", "app:main-linux-arm-v7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arch, func(t *testing.T) {
+			if got := manifestImage("app:main", tt.arch); got != tt.want {
+				t.Errorf("manifestImage(%q) = %q, want %q", tt.arch, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestNoArches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dapper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	arches, err := Arches(dir, "Dockerfile.dapper")
+	if err != nil || len(arches) != 0 {
+		t.Fatalf("Arches() = %v, %v, want none for a missing Dapperfile", arches, err)
+	}
+	err = Manifest("app:main", arches)
+	if err == nil || err.Error() != "no architectures: pass --manifest-arch or declare # DAPPER_ARCHES" {
+		t.Errorf("Manifest() error = %v, want no architectures", err)
+	}
+}
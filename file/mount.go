@@ -0,0 +1,206 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	caContext = "dapper-ca"
+	caDir     = "/usr/local/share/ca-certificates"
+)
+
+// checkBuildMounts validates --build-mount name=path values, which are passed
+// to docker build as named build contexts, and the --mount-ca path.
+func (d *Dapperfile) checkBuildMounts() error {
+	if d.MountCA != "" {
+		if _, err := os.Stat(d.path(d.MountCA)); err != nil {
+			return fmt.Errorf("Invalid --mount-ca: %v", err)
+		}
+		if !d.isBuildKit() {
+			logrus.Warnf("The CA certificates are only available to the build with BuildKit, they will still be mounted in the build container")
+		} else if err := d.prepareCAContext(); err != nil {
+			return fmt.Errorf("Invalid --mount-ca: %v", err)
+		}
+	}
+
+	if len(d.BuildMounts) == 0 {
+		return nil
+	}
+
+	if !d.isBuildKit() {
+		return fmt.Errorf("--build-mount requires BuildKit, set DOCKER_BUILDKIT=1 or install buildx")
+	}
+
+	seen := map[string]bool{}
+	for _, v := range d.BuildMounts {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("Invalid build mount %q: must be of the form name=path", v)
+		}
+		if seen[kv[0]] {
+			return fmt.Errorf("Invalid build mount %q: %s is used more than once", v, kv[0])
+		}
+		seen[kv[0]] = true
+		if _, err := os.Stat(d.path(kv[1])); err != nil {
+			return fmt.Errorf("Invalid build mount %q: %v", v, err)
+		}
+	}
+
+	return nil
+}
+
+// prepareCAContext copies the certificate into a temporary directory if
+// --mount-ca names a file, so the dapper-ca build context has only that file
+// rather than everything next to it.
+func (d *Dapperfile) prepareCAContext() error {
+	fi, err := os.Stat(d.path(d.MountCA))
+	if err != nil || fi.IsDir() || d.caContextPath != "" {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(d.path(d.MountCA))
+	if err != nil {
+		return err
+	}
+	parent, err := d.tempDir()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(parent, caContext)
+	if err != nil {
+		return err
+	}
+	d.addCleanup("CA context "+dir, func() error {
+		return os.RemoveAll(dir)
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(d.MountCA)), content, 0644); err != nil {
+		return err
+	}
+	d.caContextPath = dir
+	return nil
+}
+
+// caContextDir is the directory passed as the dapper-ca build context. For a
+// file it is the directory made by prepareCAContext, or when only printing the
+// command, the directory containing the file.
+func (d *Dapperfile) caContextDir() string {
+	if d.caContextPath != "" {
+		return d.caContextPath
+	}
+	if fi, err := os.Stat(d.path(d.MountCA)); err == nil && !fi.IsDir() {
+		return filepath.Dir(d.MountCA)
+	}
+	return d.MountCA
+}
+
+// caArgs mounts the --mount-ca file or directory where update-ca-certificates
+// looks for extra certificates, and sets DAPPER_CA to its location.
+func (d *Dapperfile) caArgs() []string {
+	hostPath, err := filepath.Abs(d.path(d.MountCA))
+	if err != nil {
+		logrus.Warnf("Not mounting the CA certificates: %v", err)
+		return nil
+	}
+
+	target := path.Join(caDir, "dapper")
+	if fi, err := os.Stat(hostPath); err == nil && !fi.IsDir() {
+		target += ".crt"
+	}
+	return []string{"-v", fmt.Sprintf("%s:%s:ro", hostPath, target), "-e", "DAPPER_CA=" + target}
+}
+
+// cacheMounts maps the --cache-mount types to cache directories, relative to
+// the home directory on the host and to the container home directory unless
+// absolute.
+var cacheMounts = map[string][][2]string{
+	"go":    {{"go/pkg/mod", "/go/pkg/mod"}, {".cache/go-build", ".cache/go-build"}},
+	"npm":   {{".npm", ".npm"}},
+	"cargo": {{".cargo/registry", ".cargo/registry"}, {".cargo/git", ".cargo/git"}},
+	"pip":   {{".cache/pip", ".cache/pip"}},
+}
+
+func checkCacheMounts(types []string) error {
+	for _, t := range types {
+		if _, ok := cacheMounts[t]; !ok {
+			return fmt.Errorf("Invalid cache mount %s: must be one of go, npm, cargo, pip", t)
+		}
+	}
+	return nil
+}
+
+// cacheMountArgs mounts the host cache directories for the --cache-mount
+// types, creating them if missing.
+func (d *Dapperfile) cacheMountArgs() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		logrus.Warnf("Not mounting caches: %v", err)
+		return nil
+	}
+
+	args := []string{}
+	for _, t := range d.CacheMounts {
+		for _, m := range cacheMounts[t] {
+			hostPath := filepath.Join(home, filepath.FromSlash(m[0]))
+			if err := os.MkdirAll(hostPath, 0755); err != nil {
+				logrus.Warnf("Not mounting %s: %v", hostPath, err)
+				continue
+			}
+			target := m[1]
+			if !path.IsAbs(target) {
+				target = path.Join(d.env.Home(), target)
+			}
+			args = append(args, "-v", fmt.Sprintf("%s:%s", hostPath, target))
+		}
+	}
+	return args
+}
+
+// outputMount splits --output-mount into the absolute host directory and
+// container directory, which is relative to DAPPER_SOURCE unless absolute.
+func (d *Dapperfile) outputMount() (string, string, error) {
+	i := strings.LastIndex(d.OutputMount, ":")
+	if i <= 0 || i == len(d.OutputMount)-1 {
+		return "", "", fmt.Errorf("Invalid output mount %q: must be of the form hostdir:containerdir", d.OutputMount)
+	}
+
+	hostDir, err := filepath.Abs(d.path(d.OutputMount[:i]))
+	if err != nil {
+		return "", "", err
+	}
+
+	containerDir := d.OutputMount[i+1:]
+	if !path.IsAbs(containerDir) {
+		containerDir = path.Join(d.env.Source(), containerDir)
+	}
+	return hostDir, path.Clean(containerDir), nil
+}
+
+func (d *Dapperfile) outputMountArgs() []string {
+	hostDir, containerDir, err := d.outputMount()
+	if err != nil {
+		logrus.Warnf("Not mounting the output directory: %v", err)
+		return nil
+	}
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		logrus.Warnf("Not mounting the output directory: %v", err)
+		return nil
+	}
+	return []string{"-v", fmt.Sprintf("%s:%s", hostDir, containerDir), "-e", "DAPPER_OUTPUT_MOUNT=" + containerDir}
+}
+
+// outputMounted reports whether p in the container is in the --output-mount
+// directory, so it does not need to be copied back.
+func (d *Dapperfile) outputMounted(p string) bool {
+	if d.OutputMount == "" {
+		return false
+	}
+	_, containerDir, err := d.outputMount()
+	return err == nil && (p == containerDir || strings.HasPrefix(p, containerDir+"/"))
+}
@@ -0,0 +1,99 @@
+package file
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	requireRe = regexp.MustCompile(`^([a-z]+)(>=|<=|==|=|>|<)v?([0-9][0-9.]*)$`)
+	versionRe = regexp.MustCompile(`v?([0-9]+(\.[0-9]+)*)`)
+)
+
+func (d *Dapperfile) checkRequires() error {
+	problems := []string{}
+
+	for _, req := range d.directives["DAPPER_REQUIRES"] {
+		m := requireRe.FindStringSubmatch(req)
+		if m == nil {
+			return fmt.Errorf("Invalid DAPPER_REQUIRES entry %q: must be of the form tool>=version", req)
+		}
+		tool, op, want := m[1], m[2], m[3]
+
+		have, err := d.toolVersion(tool)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s%s is required but %v", tool, op, want, err))
+			continue
+		}
+
+		if !compareVersions(have, op, want) {
+			problems = append(problems, fmt.Sprintf("%s %s%s is required but found %s", tool, op, want, have))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Missing requirements: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (d *Dapperfile) toolVersion(tool string) (string, error) {
+	var args []string
+	switch tool {
+	case "docker":
+		args = []string{"version", "-f", "{{.Server.Version}}"}
+	case "buildx":
+		args = []string{"buildx", "version"}
+	default:
+		return "", fmt.Errorf("version of %s can not be checked", tool)
+	}
+
+	output, err := d.execWithOutput(args...)
+	if err != nil {
+		return "", fmt.Errorf("it is not available")
+	}
+
+	// buildx prints "github.com/docker/buildx v0.12.1 <commit>"
+	for _, field := range strings.Fields(string(output)) {
+		if m := versionRe.FindStringSubmatch(field); m != nil && strings.HasPrefix(strings.TrimPrefix(field, "v"), m[1]) {
+			return m[1], nil
+		}
+	}
+	return "", fmt.Errorf("its version could not be read from %q", strings.TrimSpace(string(output)))
+}
+
+func compareVersions(have, op, want string) bool {
+	c := 0
+	h, w := strings.Split(have, "."), strings.Split(want, ".")
+	for i := 0; i < len(h) || i < len(w); i++ {
+		var hv, wv int
+		if i < len(h) {
+			hv, _ = strconv.Atoi(h[i])
+		}
+		if i < len(w) {
+			wv, _ = strconv.Atoi(w[i])
+		}
+		if hv != wv {
+			if hv < wv {
+				c = -1
+			} else {
+				c = 1
+			}
+			break
+		}
+	}
+
+	switch op {
+	case ">=":
+		return c >= 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case "<":
+		return c < 0
+	}
+	return c == 0
+}
@@ -0,0 +1,187 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stateFile returns the file the build state of the base directory is kept
+// in, under the user cache directory so it is not part of the source or the
+// build context.
+func (d *Dapperfile) stateFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	cwd, err := d.workDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(cwd))
+	return filepath.Join(dir, "dapper", fmt.Sprintf("state-%x.json", sum[:8])), nil
+}
+
+type buildState struct {
+	Hash  string `json:"hash"`
+	Image string `json:"image"`
+}
+
+func (d *Dapperfile) inputHash(dapperFile []byte) (string, error) {
+	h := sha256.New()
+	h.Write(dapperFile)
+
+	args := append([]string{}, d.Args...)
+	sort.Strings(args)
+	fmt.Fprintf(h, "\x00args=%s\x00target=%s\x00platform=%s", strings.Join(args, "\x00"), d.Target, d.platform())
+
+	// the created time of --auto-label changes every build, so it is left out
+	labels := []string{}
+	for _, label := range append(append([]string{}, d.labels()...), d.autoLabels()...) {
+		if !strings.HasPrefix(label, ociLabelPrefix+"created=") {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	fmt.Fprintf(h, "\x00labels=%s\x00cache-from=%s", strings.Join(labels, "\x00"), strings.Join(d.CacheFrom, "\x00"))
+
+	// the build mounts and CA certificates are build contexts, so their
+	// contents go into the image like the Dockerfile's
+	for _, v := range d.BuildMounts {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if err := d.hashTree(h, "mount:"+kv[0], kv[1]); err != nil {
+			return "", err
+		}
+	}
+	if d.MountCA != "" {
+		if err := d.hashTree(h, "ca", d.MountCA); err != nil {
+			return "", err
+		}
+	}
+
+	files := []string{}
+	for _, glob := range d.IncrementalGlobs {
+		matches, err := filepath.Glob(d.path(glob))
+		if err != nil {
+			return "", fmt.Errorf("Invalid glob %s: %v", glob, err)
+		}
+		// hashed by name relative to the base directory
+		for _, m := range matches {
+			if rel, err := filepath.Rel(d.path("."), m); err == nil {
+				m = rel
+			}
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		if err := hashFile(h, d.path(file), file); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashTree hashes the files under root, a file or directory relative to the
+// base directory, by name under prefix.
+func (d *Dapperfile) hashTree(w io.Writer, prefix, root string) error {
+	root = d.path(root)
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return hashFile(w, p, prefix+"/"+filepath.ToSlash(rel))
+	})
+}
+
+func hashFile(w io.Writer, file, name string) error {
+	fi, err := os.Stat(file)
+	if err != nil || fi.IsDir() {
+		return err
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(w, "\x00file=%s\x00", name)
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (d *Dapperfile) readState() map[string]buildState {
+	state := map[string]buildState{}
+	file, err := d.stateFile()
+	if err != nil {
+		return state
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		logrus.Debugf("Ignoring invalid %s: %v", file, err)
+	}
+	return state
+}
+
+func (d *Dapperfile) reuseImage(tag, hash string) bool {
+	state, ok := d.readState()[tag]
+	if !ok || state.Hash != hash || !d.imageExists(state.Image) {
+		return false
+	}
+
+	// in cp mode tag points at the image with the source copied in, so
+	// restore the tag to the image that was built from the Dockerfile
+	if _, err := d.execWithOutput("tag", state.Image, tag); err != nil {
+		logrus.Debugf("Failed to tag %s as %s: %v", state.Image, tag, err)
+		return false
+	}
+
+	return true
+}
+
+func (d *Dapperfile) saveState(tag, hash string) error {
+	output, err := d.execWithOutput("image", "inspect", "-f", "{{.Id}}", tag)
+	if err != nil {
+		return err
+	}
+
+	state := d.readState()
+	state[tag] = buildState{
+		Hash:  hash,
+		Image: strings.TrimSpace(string(output)),
+	}
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := d.stateFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
@@ -0,0 +1,212 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type templateVars struct {
+	GitCommit  string
+	GitBranch  string
+	GitTag     string
+	GitVersion string
+	HostArch   string
+	Date       string
+	Args       map[string]string
+}
+
+func (d *Dapperfile) templateVars() templateVars {
+	_, arch := d.targetOSArch()
+	return templateVars{
+		GitCommit:  d.gitOutput("rev-parse", "HEAD"),
+		GitBranch:  d.gitOutput("rev-parse", "--abbrev-ref", "HEAD"),
+		GitTag:     d.gitOutput("describe", "--tags", "--exact-match"),
+		GitVersion: d.gitOutput("describe", "--tags", "--always", "--dirty"),
+		HostArch:   arch,
+		Date:       time.Now().UTC().Format("20060102"),
+	}
+}
+
+const ociLabelPrefix = "org.opencontainers.image."
+
+// autoLabels returns the OCI provenance labels added by --auto-label, except
+// those suppressed by --no-auto-label or set explicitly with --label. The git
+// labels are left out when not in a git repository. They are computed once,
+// so every image built by one invocation has the same labels.
+func (d *Dapperfile) autoLabels() []string {
+	if !d.AutoLabel {
+		return nil
+	}
+	if d.autoLabelValues != nil {
+		return d.autoLabelValues
+	}
+
+	ref := d.gitOutput("describe", "--tags", "--exact-match")
+	if ref == "" {
+		if ref = d.gitOutput("rev-parse", "--abbrev-ref", "HEAD"); ref == "HEAD" {
+			ref = ""
+		}
+	}
+	source := d.gitOutput("remote", "get-url", "origin")
+	if u, err := url.Parse(source); err == nil && u.User != nil {
+		// never leak credentials embedded in the remote URL
+		u.User = nil
+		source = u.String()
+	}
+
+	values := []struct{ name, value string }{
+		{"revision", d.gitOutput("rev-parse", "HEAD")},
+		{"source", source},
+		{"ref.name", ref},
+		{"created", time.Now().UTC().Format(time.RFC3339)},
+	}
+
+	skip := map[string]bool{}
+	for _, name := range d.NoAutoLabel {
+		skip[strings.TrimPrefix(name, ociLabelPrefix)] = true
+	}
+	for _, label := range d.labels() {
+		skip[strings.TrimPrefix(strings.SplitN(label, "=", 2)[0], ociLabelPrefix)] = true
+	}
+
+	labels := []string{}
+	for _, v := range values {
+		if v.value == "" || skip[v.name] {
+			continue
+		}
+		labels = append(labels, ociLabelPrefix+v.name+"="+v.value)
+	}
+	d.autoLabelValues = labels
+	return labels
+}
+
+func (d *Dapperfile) gitOutput(args ...string) string {
+	output, err := d.command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func (d *Dapperfile) args() map[string]string {
+	args := map[string]string{}
+	for _, v := range d.Args {
+		kv := strings.SplitN(v, "=", 2)
+		args[kv[0]] = kv[1]
+	}
+	return args
+}
+
+var (
+	argRef        = regexp.MustCompile(`\.Args\.([A-Za-z_][A-Za-z0-9_]*)`)
+	errMissingArg = errors.New("build arg referenced by the template is not set")
+)
+
+// expandTemplates expands {{.Var}} references in the tag and label values,
+// leaving Tag and Labels as given so they can be expanded again. Build args
+// referenced by the tag are sanitized to the characters allowed in a tag, and
+// if one is not set or the result is not a valid image reference the default
+// tag is used.
+func (d *Dapperfile) expandTemplates() error {
+	var vars *templateVars
+
+	expand := func(value string, sanitize bool) (string, error) {
+		if !strings.Contains(value, "{{") {
+			return value, nil
+		}
+		if vars == nil {
+			v := d.templateVars()
+			vars = &v
+		}
+
+		vars.Args = d.args()
+		for _, m := range argRef.FindAllStringSubmatch(value, -1) {
+			if _, ok := vars.Args[m[1]]; !ok {
+				return "", fmt.Errorf("%w: %s", errMissingArg, m[1])
+			}
+		}
+		if sanitize {
+			for k, v := range vars.Args {
+				vars.Args[k] = sanitizeArg(v)
+			}
+		}
+
+		t, err := template.New("").Option("missingkey=error").Parse(value)
+		if err != nil {
+			return "", fmt.Errorf("Invalid template %q: %v", value, err)
+		}
+		buf := &bytes.Buffer{}
+		if err := t.Execute(buf, vars); err != nil {
+			return "", fmt.Errorf("Failed to expand %q, the available variables are "+
+				"GitCommit, GitBranch, GitTag, GitVersion, HostArch, Date and Args.<NAME>: %v", value, err)
+		}
+		return buf.String(), nil
+	}
+
+	tag, err := expand(d.Tag, true)
+	if errors.Is(err, errMissingArg) {
+		logrus.Warnf("Using the default tag, %v", err)
+		tag, err = "", nil
+	}
+	if err != nil {
+		return err
+	}
+	if tag != d.Tag {
+		tag = renderedTag(d.Tag, tag)
+	}
+	d.expandedTag = tag
+
+	d.expandedLabels = make([]string, len(d.Labels))
+	for i, label := range d.Labels {
+		if d.expandedLabels[i], err = expand(label, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var invalidTagChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// sanitizeArg replaces the characters not allowed in a tag in a build arg
+// value used by the template --tag with -, keeping those in the
+// DAPPER_TAG_SANITIZE character class instead if it is set.
+func sanitizeArg(v string) string {
+	if os.Getenv("DAPPER_TAG_SANITIZE") != "" {
+		return sanitizeTag(v)
+	}
+	return invalidTagChars.ReplaceAllLiteralString(v, "-")
+}
+
+// renderedTag checks the expansion of the template --tag, replacing the
+// characters not allowed in the tag part with -. It returns "", for the
+// default tag, if the result is still not a valid image reference.
+func renderedTag(template, tag string) string {
+	name, part := tag, ""
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		name, part = tag[:i], invalidTagChars.ReplaceAllLiteralString(tag[i+1:], "-")
+		tag = name + ":" + part
+	}
+	if !imageRef.MatchString(tag) || strings.HasSuffix(tag, ":") {
+		logrus.Warnf("Using the default tag, %q expands to the invalid tag %q", template, tag)
+		return ""
+	}
+	return tag
+}
+
+// labels returns the labels with templates expanded.
+func (d *Dapperfile) labels() []string {
+	if d.expandedLabels != nil {
+		return d.expandedLabels
+	}
+	return d.Labels
+}
@@ -0,0 +1,29 @@
+package file
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSanitizeArg(t *testing.T) {
+	tests := []struct {
+		name     string
+		sanitize string
+		value    string
+		want     string
+	}{
+		{"version", "", "1.2.3_rc1", "1.2.3_rc1"},
+		{"slashes and spaces", "", "feature/foo bar", "feature-foo-bar"},
+		{"DAPPER_TAG_SANITIZE", "a-zA-Z0-9", "1.2.3_rc1", "1-2-3-rc1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("DAPPER_TAG_SANITIZE", tt.sanitize)
+			defer os.Unsetenv("DAPPER_TAG_SANITIZE")
+			if got := sanitizeArg(tt.value); got != tt.want {
+				t.Errorf("sanitizeArg(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,18 @@
 package file
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -36,11 +45,68 @@ func toMap(str string) map[string]string {
 	return kv
 }
 
+// MaxLineSize is the longest Dockerfile line that can be read
+var MaxLineSize = 4 * 1024 * 1024
+
+func (d *Dapperfile) newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MaxLineSize)
+	return scanner
+}
+
+func (d *Dapperfile) scanErr(err error) error {
+	if err == bufio.ErrTooLong {
+		return fmt.Errorf("%s has a line longer than %d bytes, use --max-line-size to raise the limit", d.File, MaxLineSize)
+	}
+	return err
+}
+
+// path resolves p against the base directory given with --directory.
+func (d *Dapperfile) path(p string) string {
+	if d.Dir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(d.Dir, p)
+}
+
+// workDir returns the absolute base directory.
+func (d *Dapperfile) workDir() (string, error) {
+	if d.Dir == "" {
+		return os.Getwd()
+	}
+	return filepath.Abs(d.Dir)
+}
+
+// command returns a command run in the base directory.
+func (d *Dapperfile) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = d.Dir
+	return cmd
+}
+
+func (d *Dapperfile) tempDir() (string, error) {
+	if d.TempDir == "" {
+		return d.path("."), nil
+	}
+	dir := d.path(d.TempDir)
+	if fi, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("Invalid temp directory %s: %v", d.TempDir, err)
+	} else if !fi.IsDir() {
+		return "", fmt.Errorf("Invalid temp directory %s: not a directory", d.TempDir)
+	}
+	return dir, nil
+}
+
 func (d *Dapperfile) tempfile(content []byte) (string, error) {
-	tempfile, err := ioutil.TempFile(".", d.File)
+	dir, err := d.tempDir()
 	if err != nil {
 		return "", err
 	}
+
+	tempfile, err := ioutil.TempFile(dir, filepath.Base(d.File))
+	if err != nil {
+		return "", fmt.Errorf("Failed to create tempfile in %s: %v", dir, err)
+	}
 	defer tempfile.Close()
 
 	logrus.Debugf("Created tempfile %s", tempfile.Name())
@@ -51,3 +117,261 @@ func (d *Dapperfile) tempfile(content []byte) (string, error) {
 
 	return tempfile.Name(), nil
 }
+
+var parserDirective = regexp.MustCompile(`^#\s*([a-zA-Z]+)\s*=\s*(\S+)\s*$`)
+
+// imageRef follows the reference grammar of the distribution project: an
+// optional registry host and port, lowercase path components, an optional
+// tag and an optional digest.
+var imageRef = regexp.MustCompile(`^` +
+	`(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?` +
+	`(?:@sha256:[a-f0-9]{64})?$`)
+
+// withoutParserDirective removes the named parser directive.
+func withoutParserDirective(dockerfile []byte, name string) []byte {
+	lines := strings.Split(string(dockerfile), "\n")
+	for i, line := range lines {
+		m := parserDirective.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		if strings.ToLower(m[1]) == name {
+			return []byte(strings.Join(append(lines[:i], lines[i+1:]...), "\n"))
+		}
+	}
+	return dockerfile
+}
+
+func parserDirectives(dockerfile []byte) map[string]string {
+	directives := map[string]string{}
+
+	for _, line := range strings.Split(string(dockerfile), "\n") {
+		m := parserDirective.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		directives[strings.ToLower(m[1])] = m[2]
+	}
+
+	return directives
+}
+
+func baseImages(dockerfile []byte) []string {
+	stages := map[string]bool{}
+	seen := map[string]bool{}
+	images := []string{}
+
+	for _, line := range strings.Split(string(dockerfile), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		image := fields[0]
+		skip := stages[strings.ToLower(image)] || strings.EqualFold(image, "scratch") ||
+			strings.Contains(image, "$") || seen[image]
+
+		if len(fields) == 3 && strings.EqualFold(fields[1], "AS") {
+			stages[strings.ToLower(fields[2])] = true
+		}
+
+		if skip {
+			continue
+		}
+
+		seen[image] = true
+		images = append(images, image)
+	}
+
+	return images
+}
+
+func timezoneArgs() []string {
+	args := []string{}
+
+	if _, err := os.Stat("/etc/localtime"); err == nil {
+		args = append(args, "-v", "/etc/localtime:/etc/localtime:ro")
+	} else {
+		logrus.Debugf("Not mounting /etc/localtime: %v", err)
+	}
+
+	tz := os.Getenv("TZ")
+	if tz == "" {
+		if content, err := ioutil.ReadFile("/etc/timezone"); err == nil {
+			tz = strings.TrimSpace(string(content))
+		}
+	}
+	if tz != "" {
+		args = append(args, "-e", "TZ="+tz)
+	}
+
+	return args
+}
+
+func hasWritableMount(args []string) bool {
+	for _, arg := range args {
+		for _, flag := range []string{"-v", "--volume", "--mount", "--tmpfs"} {
+			if arg == flag || strings.HasPrefix(arg, flag+"=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_./=:,@%+-]+$`)
+
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func expandEnv(s string) string {
+	return os.Expand(s, func(key string) string {
+		if key == "$" {
+			return "$"
+		}
+		return os.Getenv(key)
+	})
+}
+
+// readIgnores reads the patterns in .dockerignore style files. Exceptions
+// starting with ! are not supported and are skipped.
+func readIgnores(files ...string) ([]string, error) {
+	ignores := []string{}
+	for _, name := range files {
+		content, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+				continue
+			}
+			ignores = append(ignores, strings.Trim(filepath.ToSlash(filepath.Clean(line)), "/"))
+		}
+	}
+	return ignores, nil
+}
+
+func matchesAny(p string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, p); ok || strings.HasPrefix(p, pattern+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+var validTag = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+
+// sanitizeTag replaces the characters of a branch name that are not in the
+// DAPPER_TAG_SANITIZE character class, by default letters and digits, with -.
+func sanitizeTag(tag string) string {
+	class := os.Getenv("DAPPER_TAG_SANITIZE")
+	if class == "" {
+		return re.ReplaceAllLiteralString(tag, "-")
+	}
+
+	custom, err := regexp.Compile("[^" + class + "]")
+	if err != nil {
+		logrus.Warnf("Ignoring DAPPER_TAG_SANITIZE %q: %v", class, err)
+		return re.ReplaceAllLiteralString(tag, "-")
+	}
+
+	result := custom.ReplaceAllLiteralString(tag, "-")
+	if !validTag.MatchString(result) {
+		logrus.Warnf("Ignoring DAPPER_TAG_SANITIZE %q, it turns %q into the invalid tag %q", class, tag, result)
+		return re.ReplaceAllLiteralString(tag, "-")
+	}
+	return result
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"b": 1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// parseSize parses a number of bytes with an optional b, k, m, g or t suffix.
+func parseSize(size string) (int64, error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+	number := strings.TrimRight(size, "bkmgt")
+	unit, ok := sizeUnits[size[len(number):]]
+	n, err := strconv.ParseInt(number, 10, 64)
+	if !ok || err != nil || n < 0 || strings.HasPrefix(number, "+") {
+		return 0, fmt.Errorf("must be a number of bytes with an optional b, k, m, g or t suffix, such as 2g")
+	}
+	if n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("must be less than 8 exabytes")
+	}
+	return n * unit, nil
+}
+
+func validateShmSize(size string) error {
+	if _, err := parseSize(size); err != nil {
+		return fmt.Errorf("Invalid shm size %q: %v", size, err)
+	}
+	return nil
+}
+
+var signalNames = map[string]bool{
+	"ABRT": true, "ALRM": true, "BUS": true, "CHLD": true, "CONT": true, "FPE": true, "HUP": true,
+	"ILL": true, "INT": true, "IO": true, "IOT": true, "KILL": true, "PIPE": true, "POLL": true,
+	"PROF": true, "PWR": true, "QUIT": true, "SEGV": true, "STKFLT": true, "STOP": true, "SYS": true,
+	"TERM": true, "TRAP": true, "TSTP": true, "TTIN": true, "TTOU": true, "URG": true, "USR1": true,
+	"USR2": true, "VTALRM": true, "WINCH": true, "XCPU": true, "XFSZ": true,
+}
+
+var rtSignal = regexp.MustCompile(`^RTM(IN|AX)([+-][0-9]+)?$`)
+
+// validateSignal accepts the signal names and numbers docker accepts, with or
+// without the SIG prefix.
+func validateSignal(signal string) error {
+	if n, err := strconv.Atoi(signal); err == nil && n > 0 && n <= 64 {
+		return nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	if signalNames[name] || rtSignal.MatchString(name) {
+		return nil
+	}
+	return fmt.Errorf("Invalid stop signal %q: must be a signal name such as SIGTERM or a number", signal)
+}
+
+func validateGpus(gpus string) error {
+	spec := strings.Trim(gpus, `"'`)
+	if spec == "all" {
+		return nil
+	}
+	if _, err := strconv.Atoi(spec); err == nil {
+		return nil
+	}
+
+	kv := strings.SplitN(strings.Split(spec, ",")[0], "=", 2)
+	if len(kv) == 2 {
+		switch kv[0] {
+		case "count", "device", "driver", "capabilities":
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Invalid GPU request %q: must be all, a count, or a device spec such as device=0", gpus)
+}
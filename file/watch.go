@@ -0,0 +1,178 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const watchInterval = time.Second
+
+type fileSnapshot map[string]string
+
+// Watch runs the command like Run, then runs it again each time files in the
+// base directory change, until interrupted. Files matched by .dockerignore
+// or .dapperignore are not watched. Changes are found by polling.
+func (d *Dapperfile) Watch(commandArgs []string) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	ignores, err := readIgnores(d.path(".dockerignore"), d.path(".dapperignore"))
+	if err != nil {
+		return err
+	}
+
+	// the Dockerfile is watched even when it is outside the base directory
+	dockerfile, err := filepath.Abs(d.path(d.File))
+	if err != nil {
+		return err
+	}
+	root, err := d.workDir()
+	if err != nil {
+		return err
+	}
+
+	runExisting := d.RunExisting
+	for {
+		// snapshot before running, so changes made during the run are seen
+		before, err := snapshotFiles(root, ignores, dockerfile)
+		if err != nil {
+			return err
+		}
+
+		if err := d.Run(commandArgs); err != nil {
+			logrus.Errorf("Run failed: %v", err)
+		}
+
+		// output copied back by the run is not a change to the source
+		outputs := d.copiedBack()
+		before.remove(root, outputs)
+		ignores := append(ignores[:len(ignores):len(ignores)], outputs...)
+
+		select {
+		case <-interrupt:
+			return nil
+		default:
+		}
+
+		logrus.Infof("Waiting for changes, press Ctrl-C to stop")
+		after, err := waitForChange(before, root, ignores, dockerfile, interrupt)
+		if err != nil || after == nil {
+			return err
+		}
+
+		// In bind mode the source is mounted, so the image only needs to be
+		// rebuilt when the Dockerfile changes
+		rebuild := before[dockerfile] != after[dockerfile]
+		d.RunExisting = runExisting || (d.IsBind() && !rebuild && d.imageExists(d.tag()))
+		logrus.Infof("Files changed, running again")
+	}
+}
+
+// waitForChange polls until the files differ from before and then stay the
+// same for one interval. It returns nil if interrupted.
+func waitForChange(before fileSnapshot, root string, ignores []string, dockerfile string, interrupt chan os.Signal) (fileSnapshot, error) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	var changed fileSnapshot
+	for {
+		select {
+		case <-interrupt:
+			return nil, nil
+		case <-ticker.C:
+		}
+
+		current, err := snapshotFiles(root, ignores, dockerfile)
+		if err != nil {
+			return nil, err
+		}
+
+		if changed != nil && current.equal(changed) {
+			return current, nil
+		}
+		if changed != nil || !current.equal(before) {
+			changed = current
+		}
+	}
+}
+
+// snapshotFiles returns the size and modification time of the files in the
+// absolute directory root and of dockerfile, by absolute path.
+func snapshotFiles(root string, ignores []string, dockerfile string) (fileSnapshot, error) {
+	snapshot := fileSnapshot{}
+	if fi, err := os.Stat(dockerfile); err == nil {
+		snapshot[dockerfile] = fmt.Sprintf("%d/%d", fi.Size(), fi.ModTime().UnixNano())
+	}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if (fi.IsDir() && rel == ".git") || matchesAny(filepath.ToSlash(rel), ignores) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() {
+			snapshot[p] = fmt.Sprintf("%d/%d", fi.Size(), fi.ModTime().UnixNano())
+		}
+		return nil
+	})
+	return snapshot, err
+}
+
+// copiedBack returns the paths relative to the base directory that Run
+// copies back to, to be ignored by Watch.
+func (d *Dapperfile) copiedBack() []string {
+	plan, err := d.CopyPlan()
+	if err != nil {
+		return nil
+	}
+	paths := []string{}
+	for _, e := range plan {
+		paths = append(paths, filepath.ToSlash(filepath.Join(e.Destination, path.Base(e.Source))))
+	}
+	if d.ManifestFile != "" {
+		paths = append(paths, filepath.ToSlash(filepath.Clean(d.ManifestFile)))
+	}
+	return paths
+}
+
+// remove deletes the files in the directory root matching patterns.
+func (s fileSnapshot) remove(root string, patterns []string) {
+	for p := range s {
+		if rel, err := filepath.Rel(root, p); err == nil && matchesAny(filepath.ToSlash(rel), patterns) {
+			delete(s, p)
+		}
+	}
+}
+
+func (s fileSnapshot) equal(other fileSnapshot) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for k, v := range s {
+		if other[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/rancher/dapper/file"
 	"github.com/sirupsen/logrus"
@@ -15,12 +18,17 @@ var (
 
 func main() {
 	exit := func(err error) {
-		if err == file.ErrSkipBuild {
+		if errors.Is(err, file.ErrNoChanges) {
+			logrus.Infof("Build skipped, nothing changed")
+			os.Exit(42)
+		}
+		if errors.Is(err, file.ErrSkipBuild) {
 			logrus.Infof("Build not supported on this architecture")
 			os.Exit(42)
 		}
 		if err != nil {
-			logrus.Fatal(err)
+			logrus.Error(err)
+			os.Exit(exitCode(err))
 		}
 	}
 
@@ -34,20 +42,41 @@ func main() {
 
 	DAPPER_SOURCE          The destination directory in the container to bind/copy the source
 	DAPPER_CP              The location in the host to find the source
+	DAPPER_CP_EXCLUDE      Patterns to exclude when copying the source in CP mode
 	DAPPER_OUTPUT          The files you want copied to the host in CP mode
 	DAPPER_DOCKER_SOCKET   Whether the Docker socket should be bound in
 	DAPPER_RUN_ARGS        Args to add to the docker run command when building
-	DAPPER_ENV             Env vars that should be copied into the build`
+	DAPPER_ENV             Env vars that should be copied into the build
+	DAPPER_RUN_GPUS        GPU devices to add to the build container
+	DAPPER_INJECT          Host values to set as DAPPER_HOST_* env vars in the build
+	DAPPER_CP_BASE         An image to also copy the source into in CP mode, tagged <tag>-cp
+	DAPPER_RUN_GROUP_ADD   Additional groups for the build container user, comma or space separated
+	DAPPER_RUN_SHM_SIZE    Size of /dev/shm in the build container, such as 2g
+	DAPPER_RUN_SYSCTL      Space separated key=value sysctls to set in the build container
+	DAPPER_SOCKET_PATH     Where the Docker socket is mounted in the build container
+	DAPPER_RUN_LOG_DRIVER  Logging driver for the build container
+	DAPPER_RUN_LOG_OPT     Space separated key=value logging driver options for the build container
+	DAPPER_CP_CHMOD        Octal mode of the source copied into the image in CP mode
+	DAPPER_RUN_CMD         Command to run when none is given, default is the image CMD
+	DAPPER_MAX_IMAGE_SIZE  Fail the build if the image is larger than this, such as 2g
+	DAPPER_MAX_LAYERS      Fail the build if the image has more layers than this
+
+	Host variables
+
+	DAPPER_TAG_SANITIZE    Characters to keep in the branch name for the default tag, default is a-zA-Z0-9
+	DAPPER_ARCH_CMD        Command that prints the host arch to use, instead of asking the Docker daemon`
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "file, f",
-			Value: "Dockerfile.dapper",
-			Usage: "Dockerfile to build from",
+			Name:   "file, f",
+			Value:  "Dockerfile.dapper",
+			Usage:  "Dockerfile to build from",
+			EnvVar: "DAPPER_DOCKERFILE",
 		},
-		cli.BoolFlag{
+		cli.GenericFlag{
 			Name:  "socket, k",
-			Usage: "Bind in the Docker socket",
+			Value: &triState{value: "auto"},
+			Usage: "Bind in the Docker socket: true, false to override DAPPER_DOCKER_SOCKET, or auto to follow it",
 		},
 		cli.StringFlag{
 			Name:   "mode, m",
@@ -64,7 +93,7 @@ func main() {
 			Usage: "Perform Dapperfile build",
 		},
 		cli.StringFlag{
-			Name:  "directory, C",
+			Name:  "directory, chdir, C",
 			Value: ".",
 			Usage: "The directory in which to run, --file is relative to this",
 		},
@@ -97,6 +126,319 @@ func main() {
 			Name:  "target",
 			Usage: "The multistage build target to use",
 		},
+		cli.BoolFlag{
+			Name:  "prepull",
+			Usage: "Pull base images in parallel before building",
+		},
+		cli.BoolFlag{
+			Name:  "no-id-env",
+			Usage: "Do not set DAPPER_UID and DAPPER_GID in the container",
+		},
+		cli.StringFlag{
+			Name:   "tmpdir",
+			Usage:  "Directory for temporary Dockerfiles, defaults to the current directory",
+			EnvVar: "DAPPER_TMPDIR",
+		},
+		cli.BoolFlag{
+			Name:  "print-command",
+			Usage: "Print the docker build and run commands without running them",
+		},
+		cli.StringFlag{
+			Name:  "gpus",
+			Usage: "GPU devices to add to the build container (all, a count, or a device spec)",
+		},
+		cli.BoolFlag{
+			Name:  "mount-git",
+			Usage: "Bind in ~/.gitconfig and ~/.git-credentials read-only",
+		},
+		cli.StringSliceFlag{
+			Name:  "output",
+			Usage: "Additional file to copy back after the build (in --mode cp), may be repeated",
+		},
+		cli.StringSliceFlag{
+			Name:  "output-only",
+			Usage: "File to copy back instead of DAPPER_OUTPUT (in --mode cp), may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "rm",
+			Usage: "Let docker remove the build container when there is no output to copy back",
+		},
+		cli.BoolFlag{
+			Name:  "context-from-stdin",
+			Usage: "Read the build context as a tar stream from stdin, --file names the Dockerfile in the tar",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-from",
+			Usage: "External cache source for the build (an image or type=...), may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Platform to build for, such as linux/arm64 or windows/amd64",
+		},
+		cli.StringSliceFlag{
+			Name:   "secret-arg",
+			Usage:  "Build arg to pass as a BuildKit secret instead of --build-arg, may be repeated",
+			EnvVar: "DAPPER_SECRET_ARGS",
+		},
+		cli.StringFlag{
+			Name:  "shell-args",
+			Usage: "Arguments to pass to the shell (with --shell), such as -l for a login shell",
+		},
+		cli.BoolFlag{
+			Name:  "show-dockerfile",
+			Usage: "Print the Dockerfile that would be built, after substitutions, and exit",
+		},
+		cli.BoolFlag{
+			Name:  "no-emulation-check",
+			Usage: "Do not check that QEMU emulation is registered before running foreign arch images",
+		},
+		cli.StringSliceFlag{
+			Name:  "build-arg-file",
+			Usage: "Set build arg NAME to the contents of a file, as NAME=path, may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "no-cleanup-on-failure",
+			Usage: "Keep temp files and the build container when the build fails, for debugging",
+		},
+		cli.BoolFlag{
+			Name:  "cleanup-image",
+			Usage: "Delete the built image when the build or run fails",
+		},
+		cli.StringFlag{
+			Name:  "manifest",
+			Usage: "Create and push a manifest list from the images tagged <manifest>-<arch>",
+		},
+		cli.StringSliceFlag{
+			Name:  "manifest-arch",
+			Usage: "Architecture to include in --manifest, such as arm64 or windows/amd64, may be repeated, default is DAPPER_ARCHES",
+		},
+		cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "Run the build container with a read-only root filesystem",
+		},
+		cli.BoolFlag{
+			Name:  "incremental",
+			Usage: "Skip the image build when the Dockerfile, build args and --incremental-glob files are unchanged",
+		},
+		cli.StringSliceFlag{
+			Name:  "incremental-glob",
+			Usage: "Files to include in the --incremental check, may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "Build the image even if --incremental finds no changes",
+		},
+		cli.StringFlag{
+			Name:  "iidfile",
+			Usage: "Write the ID of the image built from the Dockerfile to a file",
+		},
+		cli.BoolFlag{
+			Name:  "debug-shell",
+			Usage: "Launch a shell in the environment used to run the given command",
+		},
+		cli.StringFlag{
+			Name:  "tag, t",
+			Usage: "Tag for the built image instead of <directory>:<branch>, may use {{.GitVersion}} etc",
+		},
+		cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "Label to set on the built image as key=value, may use {{.GitCommit}} etc, may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "mount-timezone",
+			Usage: "Use the timezone of the host in the build container",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Kill the build container if it runs longer than this, such as 30m, or stop it with --stop-signal or --stop-timeout",
+		},
+		cli.StringFlag{
+			Name:  "dockerfile-syntax",
+			Usage: "Add a # syntax= directive to the Dockerfile if it has none, such as docker/dockerfile:1",
+		},
+		cli.IntFlag{
+			Name:  "max-line-size",
+			Value: 4 * 1024 * 1024,
+			Usage: "Longest Dockerfile line, in bytes, that can be read",
+		},
+		cli.StringSliceFlag{
+			Name:  "build-mount",
+			Usage: "Host path to make available to the build as a named context (name=path), may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "print-arch",
+			Usage: "Print the architecture used to pick the image from the # FROM map and exit",
+		},
+		cli.StringFlag{
+			Name:  "cp-base",
+			Usage: "Image to also copy the source into in CP mode, tagged <tag>-cp, overrides DAPPER_CP_BASE",
+		},
+		cli.StringSliceFlag{
+			Name:  "group-add",
+			Usage: "Additional group for the build container user, may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "socket-group",
+			Usage: "Add the group owning the docker socket to the build container user when the socket is mounted",
+		},
+		cli.StringFlag{
+			Name:  "shm-size",
+			Usage: "Size of /dev/shm in the build container, such as 2g, overrides DAPPER_RUN_SHM_SIZE",
+		},
+		cli.BoolFlag{
+			Name:  "run-existing, run-only",
+			Usage: "Run the command in the existing image for the tag without building it, fail if there is none",
+		},
+		cli.StringSliceFlag{
+			Name:  "run-label",
+			Usage: "Label to add to the build container (key=value), may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "strict-arch",
+			Usage: "Fail if a # FROM map has no image for the target architecture",
+		},
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "Run again whenever files in the current directory change, until interrupted",
+		},
+		cli.StringFlag{
+			Name:   "env-prefix",
+			Value:  "DAPPER_",
+			Usage:  "Prefix of the Dockerfile variables that configure dapper",
+			EnvVar: "DAPPER_ENV_PREFIX",
+		},
+		cli.BoolFlag{
+			Name:  "clean-env",
+			Usage: "Run docker with only PATH, HOME, DOCKER_* and the variables passed to the build from the host environment",
+		},
+		cli.StringSliceFlag{
+			Name:  "clean-env-allow",
+			Usage: "Host environment variable to keep with --clean-env, may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "copy",
+			Usage: "Copy the source into the build container, same as --mode cp",
+		},
+		cli.BoolFlag{
+			Name:  "bind",
+			Usage: "Bind mount the source into the build container, same as --mode bind",
+		},
+		cli.StringFlag{
+			Name:  "mount-ca",
+			Usage: "CA certificate file or directory to make available to the build and mount in the build container",
+		},
+		cli.StringFlag{
+			Name:  "teardown",
+			Usage: "Command to run after the build container is removed, whether or not the run failed",
+		},
+		cli.StringFlag{
+			Name:  "tag-file",
+			Usage: "Write the tag of the built image to a file",
+		},
+		cli.BoolFlag{
+			Name:  "compress-context",
+			Usage: "Compress the build context with gzip before sending it to the Docker daemon",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-mount",
+			Usage: "Mount the host cache for go, npm, cargo or pip in the build container, may be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "build-only",
+			Usage: "Build the image, including the source in CP mode, print its tag and exit without running it",
+		},
+		cli.StringFlag{
+			Name:  "debug-bundle",
+			Usage: "Write the generated Dockerfile, build args, settings and build command to a directory before building",
+		},
+		cli.IntFlag{
+			Name:  "run-retries",
+			Usage: "Number of times to run the command again in a new build container if it fails",
+		},
+		cli.IntSliceFlag{
+			Name:  "retry-on",
+			Usage: "Exit code of the command to retry on with --run-retries, may be repeated, default is any except 125, 126, 127 and 130",
+		},
+		cli.StringFlag{
+			Name:  "output-mount",
+			Usage: "Bind mount a host directory for build output (hostdir:containerdir), instead of copying it back",
+		},
+		cli.StringFlag{
+			Name:  "run-platform",
+			Usage: "Platform to run the build container as, such as linux/arm64, default is the build platform",
+		},
+		cli.BoolFlag{
+			Name:  "print-copy-plan",
+			Usage: "Print the outputs that would be copied back to the host as JSON and exit",
+		},
+		cli.StringFlag{
+			Name:  "changed-since",
+			Usage: "Skip the build if no --watch-paths files changed since this git ref",
+		},
+		cli.StringSliceFlag{
+			Name:  "watch-paths",
+			Usage: "Path or glob checked by --changed-since, may be repeated, default is any file",
+		},
+		cli.StringFlag{
+			Name:  "frontend",
+			Usage: "BuildKit frontend image to parse the Dockerfile with, replacing any # syntax= directive",
+		},
+		cli.BoolFlag{
+			Name:  "delta-copy",
+			Usage: "Only copy back output files that differ from the copy on the host",
+		},
+		cli.StringFlag{
+			Name:  "stop-signal",
+			Usage: "Signal to stop the build container with, such as SIGINT, default is docker's",
+		},
+		cli.DurationFlag{
+			Name:  "stop-timeout",
+			Usage: "Time to wait after the stop signal before killing the build container, such as 30s, default is docker's",
+		},
+		cli.StringFlag{
+			Name:  "only-copy",
+			Usage: "Copy back the output from this existing build container, such as one kept with --keep, without building or running",
+		},
+		cli.BoolFlag{
+			Name:  "inline-cache",
+			Usage: "Embed build cache metadata in the image so it can be used with --cache-from once pushed",
+		},
+		cli.BoolFlag{
+			Name:  "no-arch-cache",
+			Usage: "Always ask the Docker daemon for its OS and architecture instead of using the cached values",
+		},
+		cli.StringFlag{
+			Name:  "manifest-file",
+			Usage: "Write the path, size and sha256 of each file copied back to this file as JSON",
+		},
+		cli.BoolFlag{
+			Name:  "auto-label",
+			Usage: "Label the image with the OCI revision, source, ref.name and created labels from git",
+		},
+		cli.StringSliceFlag{
+			Name:  "no-auto-label",
+			Usage: "Leave out this --auto-label label, such as created, may be repeated",
+		},
+		cli.StringFlag{
+			Name:  "max-image-size",
+			Usage: "Fail the build if the image is larger than this, such as 2g, overrides DAPPER_MAX_IMAGE_SIZE",
+		},
+		cli.IntFlag{
+			Name:  "fail-on-layers",
+			Usage: "Fail the build if the image has more layers than this, overrides DAPPER_MAX_LAYERS",
+		},
+		cli.StringFlag{
+			Name:  "file-bind",
+			Usage: "Dockerfile to build from in bind mode, instead of --file",
+		},
+		cli.StringFlag{
+			Name:  "file-copy",
+			Usage: "Dockerfile to build from in CP mode, instead of --file",
+		},
+		cli.StringFlag{
+			Name:  "verify-target",
+			Usage: "Also build this stage after the build, such as a lint stage, and fail if it fails",
+		},
 	}
 	app.Action = func(c *cli.Context) {
 		exit(run(c))
@@ -105,32 +447,258 @@ func main() {
 	exit(app.Run(os.Args))
 }
 
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, file.ErrDockerMissing):
+		return 10
+	case errors.Is(err, file.ErrBuildFailed):
+		return 11
+	case errors.Is(err, file.ErrOutputCopy):
+		return 12
+	case errors.Is(err, file.ErrTimeout):
+		return 13
+	}
+	return 1
+}
+
+// checkSocketValue rejects --socket false, which sets --socket and runs the
+// command false, since the value of a bool flag must be given with =.
+func checkSocketValue(c *cli.Context) error {
+	args := c.Args()
+	i := len(os.Args) - len(args)
+	if len(args) == 0 || i < 1 {
+		return nil
+	}
+	switch os.Args[i-1] {
+	case "--socket", "-socket", "-k", "--k":
+	default:
+		return nil
+	}
+	switch args[0] {
+	case "true", "false", "auto":
+		return fmt.Errorf("Invalid --socket %s: use --socket=%s", args[0], args[0])
+	}
+	return nil
+}
+
+// triState is a bool flag that also accepts auto, where giving the flag
+// without a value means true.
+type triState struct {
+	value string
+}
+
+func (t *triState) Set(value string) error {
+	switch value {
+	case "true", "false", "auto":
+		t.value = value
+		return nil
+	}
+	return fmt.Errorf("must be true, false or auto")
+}
+
+func (t *triState) String() string {
+	return t.value
+}
+
+func (t *triState) IsBoolFlag() bool {
+	return true
+}
+
+// modeFile returns the Dockerfile for the mode, which is --file-bind or
+// --file-copy if given, or else --file.
+func modeFile(c *cli.Context, dir, mode string) (string, error) {
+	if !c.Bool("context-from-stdin") {
+		for _, name := range []string{"file-bind", "file-copy"} {
+			if f := c.String(name); f != "" {
+				if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+					return "", fmt.Errorf("Invalid --%s: %v", name, err)
+				}
+			}
+		}
+	}
+
+	name := "file-copy"
+	if (file.Context{}).Mode(mode) == "bind" {
+		name = "file-bind"
+	}
+	if f := c.String(name); f != "" {
+		logrus.Debugf("Using %s from --%s for %s mode", f, name, mode)
+		return f, nil
+	}
+	return c.String("file"), nil
+}
+
 func run(c *cli.Context) error {
+	if err := checkSocketValue(c); err != nil {
+		return err
+	}
+	if err := applyConfig(c); err != nil {
+		return err
+	}
+
 	if c.Bool("debug") {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
-	dir := c.String("directory")
 	shell := c.Bool("shell")
 	build := c.Bool("build")
 
-	if err := os.Chdir(dir); err != nil {
-		return fmt.Errorf("Failed to change to directory %s: %v", dir, err)
+	// paths are resolved against the directory rather than changing to it
+	dir, err := filepath.Abs(c.String("directory"))
+	if err != nil {
+		return fmt.Errorf("Invalid directory %s: %v", c.String("directory"), err)
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("Invalid directory %s: %v", c.String("directory"), err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("Invalid directory %s: not a directory", c.String("directory"))
+	}
+
+	file.ArchCache = !c.Bool("no-arch-cache")
+
+	if c.Bool("print-arch") {
+		fmt.Println(file.HostArch(c.String("platform")))
+		return nil
+	}
+
+	if manifest := c.String("manifest"); manifest != "" {
+		arches := c.StringSlice("manifest-arch")
+		if len(arches) == 0 {
+			var err error
+			if arches, err = file.Arches(dir, c.String("file")); err != nil {
+				return err
+			}
+		}
+		return file.Manifest(manifest, arches)
 	}
 
-	dapperFile, err := file.Lookup(c.String("file"))
+	var dapperFile *file.Dapperfile
+	file.MaxLineSize = c.Int("max-line-size")
+	file.EnvPrefix = c.String("env-prefix")
+	if file.EnvPrefix == "" {
+		return fmt.Errorf("--env-prefix must not be empty")
+	}
+
+	mode := c.String("mode")
+	if c.Bool("copy") && c.Bool("bind") {
+		return fmt.Errorf("--copy and --bind can not be used together")
+	} else if c.Bool("copy") {
+		mode = "cp"
+	} else if c.Bool("bind") {
+		mode = "bind"
+	}
+
+	dockerfile, err := modeFile(c, dir, mode)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("context-from-stdin") {
+		if c.Bool("no-context") {
+			return fmt.Errorf("--context-from-stdin can not be used with --no-context")
+		}
+		dapperFile, err = file.LookupContext(dir, os.Stdin, dockerfile, c.String("tmpdir"))
+	} else {
+		dapperFile, err = file.Lookup(dir, dockerfile)
+	}
 	if err != nil {
 		return err
 	}
+	defer dapperFile.Close()
 
-	dapperFile.Mode = c.String("mode")
-	dapperFile.Socket = c.Bool("socket")
+	dapperFile.Mode = mode
+	socket := c.Generic("socket").(*triState).value
+	dapperFile.Socket = socket == "true"
+	dapperFile.NoSocket = socket == "false"
 	dapperFile.NoOut = c.Bool("no-out")
 	dapperFile.Quiet = c.Bool("quiet")
 	dapperFile.Keep = c.Bool("keep")
 	dapperFile.NoContext = c.Bool("no-context")
 	dapperFile.MountSuffix = c.String("mount-suffix")
 	dapperFile.Target = c.String("target")
+	dapperFile.Prepull = c.Bool("prepull")
+	dapperFile.NoIDEnv = c.Bool("no-id-env")
+	dapperFile.TempDir = c.String("tmpdir")
+	dapperFile.Gpus = c.String("gpus")
+	dapperFile.MountGit = c.Bool("mount-git")
+	dapperFile.Output = c.StringSlice("output")
+	dapperFile.OutputOnly = c.StringSlice("output-only")
+	dapperFile.Rm = c.Bool("rm")
+	dapperFile.CacheFrom = c.StringSlice("cache-from")
+	dapperFile.BuildMounts = c.StringSlice("build-mount")
+	dapperFile.CpBase = c.String("cp-base")
+	dapperFile.GroupAdd = c.StringSlice("group-add")
+	dapperFile.SocketGroup = c.Bool("socket-group")
+	dapperFile.ShmSize = c.String("shm-size")
+	dapperFile.RunExisting = c.Bool("run-existing")
+	dapperFile.RunLabels = c.StringSlice("run-label")
+	dapperFile.StrictArch = c.Bool("strict-arch")
+	dapperFile.CleanEnv = c.Bool("clean-env")
+	dapperFile.CleanEnvAllow = c.StringSlice("clean-env-allow")
+	dapperFile.MountCA = c.String("mount-ca")
+	dapperFile.Teardown = c.String("teardown")
+	dapperFile.TagFile = c.String("tag-file")
+	dapperFile.CompressContext = c.Bool("compress-context")
+	dapperFile.CacheMounts = c.StringSlice("cache-mount")
+	dapperFile.BuildOnly = c.Bool("build-only")
+	dapperFile.DebugBundle = c.String("debug-bundle")
+	dapperFile.RunRetries = c.Int("run-retries")
+	dapperFile.RetryOn = c.IntSlice("retry-on")
+	dapperFile.OutputMount = c.String("output-mount")
+	dapperFile.DeltaCopy = c.Bool("delta-copy")
+	dapperFile.RunPlatform = c.String("run-platform")
+	dapperFile.ChangedSince = c.String("changed-since")
+	dapperFile.WatchPaths = c.StringSlice("watch-paths")
+	if dapperFile.BuildOnly && dapperFile.RunExisting {
+		return fmt.Errorf("--build-only and --run-only can not be used together")
+	}
+	dapperFile.Platform = c.String("platform")
+	dapperFile.SecretArgs = c.StringSlice("secret-arg")
+	dapperFile.ShellArgs = strings.Fields(c.String("shell-args"))
+	dapperFile.NoEmulationCheck = c.Bool("no-emulation-check")
+	dapperFile.BuildArgFiles = c.StringSlice("build-arg-file")
+	dapperFile.NoCleanupOnFailure = c.Bool("no-cleanup-on-failure")
+	dapperFile.CleanupImage = c.Bool("cleanup-image")
+	dapperFile.ReadOnly = c.Bool("read-only")
+	dapperFile.Incremental = c.Bool("incremental")
+	dapperFile.IncrementalGlobs = c.StringSlice("incremental-glob")
+	dapperFile.Force = c.Bool("force")
+	dapperFile.IIDFile = c.String("iidfile")
+	dapperFile.Tag = c.String("tag")
+	dapperFile.Labels = c.StringSlice("label")
+	dapperFile.MountTimezone = c.Bool("mount-timezone")
+	dapperFile.Timeout = c.Duration("timeout")
+	dapperFile.DockerfileSyntax = c.String("dockerfile-syntax")
+	dapperFile.Frontend = c.String("frontend")
+	dapperFile.StopSignal = c.String("stop-signal")
+	dapperFile.StopTimeout = c.Duration("stop-timeout")
+	dapperFile.InlineCache = c.Bool("inline-cache")
+	dapperFile.ManifestFile = c.String("manifest-file")
+	dapperFile.AutoLabel = c.Bool("auto-label")
+	dapperFile.NoAutoLabel = c.StringSlice("no-auto-label")
+	dapperFile.MaxImageSize = c.String("max-image-size")
+	dapperFile.MaxLayers = c.Int("fail-on-layers")
+	dapperFile.VerifyTarget = c.String("verify-target")
+
+	if c.Bool("show-dockerfile") {
+		return dapperFile.ShowDockerfile()
+	}
+
+	if c.Bool("print-command") {
+		return dapperFile.PrintCommand(c.Args())
+	}
+
+	if c.Bool("print-copy-plan") {
+		return dapperFile.PrintCopyPlan()
+	}
+
+	if container := c.String("only-copy"); container != "" {
+		return dapperFile.OnlyCopy(container)
+	}
+
+	if c.Bool("debug-shell") {
+		return dapperFile.DebugShell(c.Args())
+	}
 
 	if shell {
 		return dapperFile.Shell(c.Args())
@@ -140,5 +708,12 @@ func run(c *cli.Context) error {
 		return dapperFile.Build(c.Args())
 	}
 
+	if c.Bool("watch") {
+		if c.Bool("context-from-stdin") {
+			return fmt.Errorf("--watch can not be used with --context-from-stdin")
+		}
+		return dapperFile.Watch(c.Args())
+	}
+
 	return dapperFile.Run(c.Args())
 }